@@ -21,8 +21,80 @@ static __always_inline __u32 get_direction(struct __sk_buff *skb) {
 	return EGRESS_TRAFFIC;
 }
 
-static __always_inline __u32 index_shift(__u32 direction) {
-	return direction * 10;
+// mark_ect record whether the packet can be marked instead of dropped
+static __always_inline void mark_ect(struct __sk_buff *skb, int ect) {
+	skb->cb[0] &= ~0x10;
+	if (ect) {
+		skb->cb[0] |= 0x10;
+	}
+}
+
+static __always_inline int get_ect(struct __sk_buff *skb) {
+	return (skb->cb[0] & 0x10) != 0;
+}
+
+static __always_inline int ecn_mark_enabled(void) {
+#ifdef FEAT_EDT
+	// bpf_skb_ecn_set_ce is probed for FEAT_EDT
+	__u32 key = 0;
+	struct qos_opts *opts;
+
+	opts = bpf_map_lookup_elem(&qos_opts_map, &key);
+	if (opts != NULL && (opts->flags & QOS_OPT_ECN_MARK)) {
+		return 1;
+	}
+#endif
+	return 0;
+}
+
+// set_ce mark the packet for QOS_ACT_MARK, drop it if not ECT
+static __always_inline int set_ce(struct __sk_buff *skb, int ret) {
+#ifdef FEAT_EDT
+	if (ret == QOS_ACT_MARK && !bpf_skb_ecn_set_ce(skb)) {
+		return TC_ACT_SHOT;
+	}
+#else
+	(void)skb;
+#endif
+	return ret;
+}
+
+#ifdef FEAT_CGROUP_ID
+// lookup_pod_cgroup find the host network pod of the socket on cgroup v2. Pods are indexed by the id of the pod
+// cgroup, which is an ancestor of the container cgroup the socket belongs to.
+static __always_inline const struct cgroup_info *lookup_pod_cgroup(struct __sk_buff *skb) {
+	const struct cgroup_info *info;
+	__u64 cgroup_id;
+	int level;
+
+#pragma unroll
+	for (level = 1; level <= CGROUP_LEVEL_MAX; level++) {
+		// 0 if the level is deeper than the socket cgroup
+		cgroup_id = bpf_skb_ancestor_cgroup_id(skb, level);
+		if (cgroup_id == 0)
+			break;
+		info = bpf_map_lookup_elem(&cgroup_info_map, &cgroup_id);
+		if (info != NULL)
+			return info;
+	}
+	return NULL;
+}
+#endif
+
+// lookup_global_cfg find the config of the interface, fall back to the default if it has no config of its own.
+// key is set to the one found, which also index the rate and throughput.
+static __always_inline struct global_rate_cfg *lookup_global_cfg(struct __sk_buff *skb, __u32 direction,
+								 struct global_key *key) {
+	struct global_rate_cfg *cfg;
+
+	key->ifindex   = skb->ifindex;
+	key->direction = direction;
+	cfg            = bpf_map_lookup_elem(&terway_global_cfg, key);
+	if (cfg == NULL) {
+		key->ifindex = 0;
+		cfg          = bpf_map_lookup_elem(&terway_global_cfg, key);
+	}
+	return cfg;
 }
 
 static __always_inline __u32 ctx_wire_len(struct __sk_buff *skb) {
@@ -33,128 +105,277 @@ static __always_inline __u32 ctx_wire_len(struct __sk_buff *skb) {
 #endif
 }
 
-// cal_rate cal package transferred
-static __always_inline void cal_rate(__u64 len, __u32 direction) {
-	__u64 now              = bpf_ktime_get_ns();
-	const __u32 meta_index = index_shift(direction);
-	struct net_stat *meta;
+// bytes_rate return bytes/s of the bytes transferred in elapsed ns
+static __always_inline __u64 bytes_rate(__u64 bytes, __u64 elapsed) {
+	__u64 ms;
+
+	if (elapsed == 0)
+		return 0;
+	// bytes * NSEC_PER_SEC overflows from 16GiB, fall back to the precision of ms
+	if (bytes < (1ULL << 34))
+		return bytes * NSEC_PER_SEC / elapsed;
+	ms = elapsed / NSEC_PER_MSEC;
+	if (ms == 0)
+		ms = 1;
+	return bytes / ms * 1000;
+}
 
-	__u64 index;
-	__u64 t_last, last_bytes;
-	__u64 total_bytes;
-	__u64 cur_rate;
+// est_window return the rate since the oldest snapshot within the window, and record the snapshot of now in the slot
+// of now. With no snapshot in the window, the rate since the last estimate t_last is returned.
+static __always_inline __u64 est_window(struct net_stat *stat, __u64 bytes, __u64 now, __u64 t_last, __u64 b_last,
+					__u64 width, __u32 num) {
+	__u64 span = width * num;
+	__u64 t_old = t_last, b_old = b_last;
+	__u32 i;
 
-	// use index 0 for the global rate cal
-	meta = bpf_map_lookup_elem(&terway_net_stat, &meta_index);
-	if (meta == NULL) {
-		return;
-	}
+#pragma unroll
+	for (i = 0; i < EST_SLOT_MAX; i++) {
+		__u64 ts = READ_ONCE(stat->slots[i].ts);
 
-	index      = READ_ONCE(meta->index);
-	t_last     = READ_ONCE(meta->ts);
-	last_bytes = READ_ONCE(meta->val);
+		if (i >= num || ts == 0 || ts >= t_old || now - ts > span)
+			continue;
+		t_old = ts;
+		b_old = READ_ONCE(stat->slots[i].bytes);
+	}
 
-	if (index % 10 == 0) {
-		// init it
-		WRITE_ONCE(meta->index, meta_index + 1);
-		WRITE_ONCE(meta->ts, now);
-		WRITE_ONCE(meta->val, 0);
-		index++;
-	} else if ((index + 1) % 10 == 1) {
-		index = meta_index + 1;
+	i = (now / width) % num;
+	if (i < EST_SLOT_MAX) {
+		WRITE_ONCE(stat->slots[i].ts, now);
+		WRITE_ONCE(stat->slots[i].bytes, bytes);
 	}
 
-	total_bytes = last_bytes + len;
+	// a slot torn by another cpu
+	if (bytes < b_old)
+		return READ_ONCE(stat->rate);
+	return bytes_rate(bytes - b_old, now - t_old);
+}
 
-	// aggregate every 100ms for actual bps
-	// as we calculate all package, this should always be valid...
-	if ((now - t_last) < 100 * NSEC_PER_MSEC) {
-		WRITE_ONCE(meta->val, total_bytes);
+// ewma_weight return the weight of the previous estimate, 2^(-dt/half_life) in 1/1024
+static __always_inline __u64 ewma_weight(__u64 dt, __u64 half_life) {
+	__u64 halves, f;
+
+	if (half_life == 0)
+		return 0;
+	halves = dt / half_life;
+	if (halves >= 10)
+		return 0;
+	// 2^(-f) is approximated by 1 - 0.657f + 0.157f^2 for f in [0, 1], f in 1/1024
+	f = (dt - halves * half_life) * 1024 / half_life;
+	return (1024 - 673 * f / 1024 + 161 * f * f / (1024 * 1024)) >> halves;
+}
+
+// cal_rate count the bytes on this cpu, and flush them to the shared net_stat every NET_STAT_FLUSH_NS.
+// The cpu flushing estimates the throughput once a slot passed, by the estimator of cfg, or the default window if
+// cfg is NULL. Cpus estimating at once only skew the estimate, the bytes are never lost.
+static __always_inline void cal_rate(__u64 len, const struct global_key *key, const struct global_rate_cfg *cfg) {
+	__u64 now       = bpf_ktime_get_ns();
+	__u64 width     = EST_SLOT_WIDTH_DEFAULT;
+	__u32 num       = EST_SLOT_NUM_DEFAULT;
+	__u32 estimator = ESTIMATOR_WINDOW;
+	__u64 half_life = 0;
+	struct net_stat_pcpu *pcpu;
+	struct net_stat *stat;
+	__u64 bytes, b_last, t_last, rate;
+	__u32 zero = 0;
+
+	pcpu = bpf_map_lookup_elem(&net_stat_pcpu_map, key);
+	if (pcpu == NULL) {
+		struct net_stat_pcpu init = {.t_flush = now};
+
+		bpf_map_update_elem(&net_stat_pcpu_map, key, &init, BPF_NOEXIST);
+		pcpu = bpf_map_lookup_elem(&net_stat_pcpu_map, key);
+		if (pcpu == NULL)
+			return;
+	}
+	// the value is private to this cpu, no atomic needed
+	pcpu->pending += len;
+	if (now - pcpu->t_flush < NET_STAT_FLUSH_NS)
 		return;
+
+	stat = bpf_map_lookup_elem(&terway_net_stat, key);
+	if (stat == NULL) {
+		struct net_stat *init = bpf_map_lookup_elem(&net_stat_zero, &zero);
+
+		if (init == NULL)
+			return;
+		bpf_map_update_elem(&terway_net_stat, key, init, BPF_NOEXIST);
+		stat = bpf_map_lookup_elem(&terway_net_stat, key);
+		if (stat == NULL)
+			return;
+		if (READ_ONCE(stat->ts) == 0)
+			WRITE_ONCE(stat->ts, now);
+	}
+	__sync_fetch_and_add(&stat->bytes, pcpu->pending);
+	pcpu->pending = 0;
+	pcpu->t_flush = now;
+
+	if (cfg != NULL) {
+		estimator = READ_ONCE(cfg->estimator);
+		half_life = READ_ONCE(cfg->half_life);
+		if (READ_ONCE(cfg->slot_width) != 0)
+			width = READ_ONCE(cfg->slot_width);
+		if (READ_ONCE(cfg->slot_num) != 0 && READ_ONCE(cfg->slot_num) <= EST_SLOT_MAX)
+			num = READ_ONCE(cfg->slot_num);
 	}
 
-	// always reset meta
-	WRITE_ONCE(meta->ts, now);
-	WRITE_ONCE(meta->val, 0);
+	// the slot may be started by another cpu after now was read
+	t_last = READ_ONCE(stat->ts);
+	if (now < t_last || now - t_last < width)
+		return;
+
+	bytes  = READ_ONCE(stat->bytes);
+	b_last = READ_ONCE(stat->ts_bytes);
+	// another cpu estimated the slot after bytes was read
+	if (bytes < b_last || now <= t_last)
+		return;
+	if (estimator == ESTIMATOR_EWMA) {
+		__u64 w = ewma_weight(now - t_last, half_life);
 
-	if ((now - t_last) > 300 * NSEC_PER_MSEC) {
-		// the rate has no meaning
-		cur_rate = 0;
+		rate = bytes_rate(bytes - b_last, now - t_last);
+		rate = (READ_ONCE(stat->rate) * w + rate * (1024 - w)) / 1024;
 	} else {
-		cur_rate = total_bytes * NSEC_PER_SEC / (now - t_last);
+		rate = est_window(stat, bytes, now, t_last, b_last, width, num);
 	}
+	WRITE_ONCE(stat->ts, now);
+	WRITE_ONCE(stat->rate, rate);
+	WRITE_ONCE(stat->ts_bytes, bytes);
+}
 
-	// set current bps , update by index
-	struct net_stat *cur;
-	cur = bpf_map_lookup_elem(&terway_net_stat, &index);
-	if (cur == NULL) {
-		return;
-	}
-	WRITE_ONCE(cur->val, cur_rate);
-	WRITE_ONCE(cur->ts, now);
+// get_average_rate return bytes/s estimated of the key
+static __always_inline __u64 get_average_rate(const struct global_key *key) {
+	struct net_stat *stat;
 
-	// move index
-	WRITE_ONCE(meta->index, index + 1);
+	stat = bpf_map_lookup_elem(&terway_net_stat, key);
+	if (stat == NULL)
+		return 0;
+	return READ_ONCE(stat->rate);
 }
 
-static __always_inline __u64 get_average_rate(__u32 direction) {
-	__u32 i;
-	__u64 now      = bpf_ktime_get_ns();
-	__u64 cur_rate = 0;
+// update_stat count the verdict of a packet, the map must be a per cpu map of struct qos_stat
+static __always_inline void update_stat(void *map, const void *key, __u64 len, int ret, int delayed) {
+	struct qos_stat *stat;
 
-#pragma unroll
-	for (i = 0; i < 9; i++) {
-		struct net_stat *info;
-		__u32 index = index_shift(direction) + i;
+	stat = bpf_map_lookup_elem(map, key);
+	if (stat == NULL) {
+		struct qos_stat init = {0};
 
-		info = bpf_map_lookup_elem(&terway_net_stat, &index);
-		if (info == NULL)
-			continue;
+		bpf_map_update_elem(map, key, &init, BPF_NOEXIST);
+		stat = bpf_map_lookup_elem(map, key);
+		if (stat == NULL)
+			return;
+	}
+
+	if (ret == TC_ACT_SHOT) {
+		stat->drop_bytes += len;
+		stat->drop_packets++;
+		return;
+	}
+	if (ret == QOS_ACT_MARK) {
+		stat->mark_bytes += len;
+		stat->mark_packets++;
+	}
 
-		if ((now - READ_ONCE(info->ts)) < 1000 * NSEC_PER_MSEC)
-			cur_rate += READ_ONCE(info->val);
+	stat->pass_bytes += len;
+	stat->pass_packets++;
+	if (delayed) {
+		stat->delay_bytes += len;
+		stat->delay_packets++;
 	}
-	return cur_rate / 9;
 }
 
-static __always_inline int accept(__u64 wire_len, __u64 *tokens, __u64 *t_last, __u64 byte_per_seconds) {
+// bytes_of return bytes sent at bps in ns, at most max. Overflow free for bps up to ~18GB/s.
+static __always_inline __u64 bytes_of(__u64 ns, __u64 bps, __u64 max) {
+	__u64 sec = ns / NSEC_PER_SEC;
+
+	if (sec > max / bps) {
+		return max;
+	}
+	return sec * bps + (ns % NSEC_PER_SEC) * bps / NSEC_PER_SEC;
+}
+
+// ns_of return the time to send bytes at bps, the inverse of bytes_of. Overflow free for bps up to ~18GB/s.
+static __always_inline __u64 ns_of(__u64 bytes, __u64 bps) {
+	return bytes / bps * NSEC_PER_SEC + bytes % bps * NSEC_PER_SEC / bps;
+}
+
+// accept take tokens for the packet. If the bucket runs dry, ECT packets borrow from the future by moving t_last ahead,
+// and are marked until the debt reach T_HORIZON_MARK.
+static __always_inline int accept(__u64 wire_len, __u64 *tokens, __u64 *t_last, __u64 byte_per_seconds, __u64 burst, int ect) {
 	__u64 now = bpf_ktime_get_ns();
 	__u64 t   = *tokens;
 
-	if (byte_per_seconds < MEGABYTE) {
+	if (byte_per_seconds == 0) {
 		return TC_ACT_OK;
 	}
+	if (burst == 0) {
+		burst = byte_per_seconds;
+	}
+	// a full sized packet must fit in the bucket
+	if (burst < MIN_BURST) {
+		burst = MIN_BURST;
+	}
+
+	// t_last is ahead of now while in debt, no refill until it is paid
+	if (now > *t_last) {
+		__u64 add = bytes_of(now - *t_last, byte_per_seconds, burst);
 
-	__u64 elapsed_time = (now - *t_last) / 1000; // microseconds
-	if (elapsed_time > 0) {
-		t += (byte_per_seconds * elapsed_time / MEGABYTE);
-		if (t > byte_per_seconds) {
-			t = byte_per_seconds;
+		if (t + add >= burst) {
+			t       = burst;
+			*t_last = now;
+		} else {
+			// only the time of whole bytes is consumed, the rest is kept for the next packet
+			t += add;
+			*t_last += ns_of(add, byte_per_seconds);
 		}
 	}
 
-	*t_last = now;
-
 	if (t >= wire_len) {
 		t -= wire_len;
 
 		*tokens = t;
 		return TC_ACT_OK;
-	} else {
-		*tokens = t;
-		return TC_ACT_SHOT;
 	}
+
+	*tokens = t;
+	if (ect) {
+		__u64 t_debt = *t_last + ns_of(wire_len - t, byte_per_seconds);
+
+		// the refill rounds down to whole bytes, the time of the missing bytes may have passed already
+		if (t_debt <= now) {
+			*tokens = 0;
+			*t_last = now;
+			return TC_ACT_OK;
+		}
+		if (t_debt - now < T_HORIZON_MARK) {
+			*tokens = 0;
+			*t_last = t_debt;
+			return QOS_ACT_MARK;
+		}
+	}
+	return TC_ACT_SHOT;
+}
+
+// horizon_verdict check how far ahead the packet is scheduled, packets over the horizon are dropped or marked
+static __always_inline int horizon_verdict(struct __sk_buff *skb, __u64 t_next, __u64 now) {
+	if (t_next - now < T_HORIZON_DROP) {
+		return TC_ACT_OK;
+	}
+	if (get_ect(skb) && t_next - now < T_HORIZON_MARK) {
+		return QOS_ACT_MARK;
+	}
+	return TC_ACT_SHOT;
 }
 
 static __always_inline int tb_rate_limit(struct __sk_buff *skb, struct rate_info *info) {
-	__u64 tokens, t_last, byte_per_seconds;
+	__u64 tokens, t_last, byte_per_seconds, burst;
 	__u32 rt = 0;
 
 	tokens           = READ_ONCE(info->slot3);
 	t_last           = READ_ONCE(info->t_last);
 	byte_per_seconds = READ_ONCE(info->bps);
+	burst            = READ_ONCE(info->burst);
 
-	rt = accept(ctx_wire_len(skb), &tokens, &t_last, byte_per_seconds);
+	rt = accept(ctx_wire_len(skb), &tokens, &t_last, byte_per_seconds, burst, get_ect(skb));
 
 	WRITE_ONCE(info->slot3, tokens);
 	WRITE_ONCE(info->t_last, t_last);
@@ -163,54 +384,26 @@ static __always_inline int tb_rate_limit(struct __sk_buff *skb, struct rate_info
 }
 
 static __always_inline int global_tb_rate_limit(struct __sk_buff *skb, struct global_rate_info *rate_info) {
-	switch (skb->priority) {
-	case PRIO_ONLINE: {
-		__u64 tokens, t_last, byte_per_seconds;
-		__u32 rt = 0;
-
-		tokens           = READ_ONCE(rate_info->l0_slot);
-		t_last           = READ_ONCE(rate_info->t_l0_last);
-		byte_per_seconds = READ_ONCE(rate_info->l0_bps);
-
-		rt = accept(ctx_wire_len(skb), &tokens, &t_last, byte_per_seconds);
-
-		WRITE_ONCE(rate_info->l0_slot, tokens);
-		WRITE_ONCE(rate_info->t_l0_last, t_last);
-
-		return rt;
-	}
-	case PRIO_OFFLINE_L1: {
-		__u64 tokens, t_last, byte_per_seconds;
-		__u32 rt = 0;
-
-		tokens           = READ_ONCE(rate_info->l1_slot);
-		t_last           = READ_ONCE(rate_info->t_l1_last);
-		byte_per_seconds = READ_ONCE(rate_info->l1_bps);
-
-		rt = accept(ctx_wire_len(skb), &tokens, &t_last, byte_per_seconds);
-
-		WRITE_ONCE(rate_info->l1_slot, tokens);
-		WRITE_ONCE(rate_info->t_l1_last, t_last);
+	__u64 tokens, t_last, byte_per_seconds;
+	__u32 prio = skb->priority;
+	struct class_rate *class;
+	__u32 rt = 0;
 
-		return rt;
+	if (prio >= PRIO_NUM) {
+		return TC_ACT_OK;
 	}
-	case PRIO_OFFLINE_L2: {
-		__u64 tokens, t_last, byte_per_seconds;
-		__u32 rt = 0;
+	class = &rate_info->classes[prio];
 
-		tokens           = READ_ONCE(rate_info->l2_slot);
-		t_last           = READ_ONCE(rate_info->t_l2_last);
-		byte_per_seconds = READ_ONCE(rate_info->l2_bps);
+	tokens           = READ_ONCE(class->slot);
+	t_last           = READ_ONCE(class->t_last);
+	byte_per_seconds = READ_ONCE(class->bps);
 
-		rt = accept(ctx_wire_len(skb), &tokens, &t_last, byte_per_seconds);
+	rt = accept(ctx_wire_len(skb), &tokens, &t_last, byte_per_seconds, 0, get_ect(skb));
 
-		WRITE_ONCE(rate_info->l2_slot, tokens);
-		WRITE_ONCE(rate_info->t_l2_last, t_last);
+	WRITE_ONCE(class->slot, tokens);
+	WRITE_ONCE(class->t_last, t_last);
 
-		return rt;
-	}
-	}
-	return 0;
+	return rt;
 }
 
 #ifdef FEAT_EDT
@@ -218,29 +411,52 @@ static __always_inline int edt(struct __sk_buff *skb, struct rate_info *info) {
 	if (info->bps == 0) {
 		return TC_ACT_OK;
 	}
-	__u64 delay, now, t, t_next;
+	__u64 delay, now, t, t_last, t_next, burst;
+	int ret;
 
 	now = bpf_ktime_get_ns();
 	t   = skb->tstamp;
 	if (t < now)
 		t = now;
 	delay  = (__u64)ctx_wire_len(skb) * NSEC_PER_SEC / info->bps;
-	t_next = READ_ONCE(info->t_last) + delay;
+	t_last = READ_ONCE(info->t_last);
+	burst  = READ_ONCE(info->burst);
+	if (burst > 0) {
+		// credit of an idle pod is capped to burst bytes, which may be sent without delay
+		__u64 credit = burst * NSEC_PER_SEC / info->bps;
+
+		if (t_last + credit < t)
+			t_last = t - credit;
+	}
+	t_next = t_last + delay;
 	if (t_next <= t) {
-		WRITE_ONCE(info->t_last, t);
+		WRITE_ONCE(info->t_last, burst > 0 ? t_next : t);
 		return TC_ACT_OK;
 	}
 
-	if (t_next - now >= T_HORIZON_DROP)
-		return TC_ACT_SHOT;
+	ret = horizon_verdict(skb, t_next, now);
+	if (ret == TC_ACT_SHOT)
+		return ret;
 
 	WRITE_ONCE(info->t_last, t_next);
 	skb->tstamp = t_next;
-	return TC_ACT_OK;
+	return ret;
 }
 
 static __always_inline int global_edt(struct __sk_buff *skb, struct global_rate_info *rate_info) {
-	__u64 delay, now, t, t_next;
+	__u64 delay, now, t, t_next, bps;
+	__u32 prio = skb->priority;
+	struct class_rate *class;
+	int ret;
+
+	if (prio >= PRIO_NUM) {
+		return TC_ACT_OK;
+	}
+	class = &rate_info->classes[prio];
+	bps   = READ_ONCE(class->bps);
+	if (bps == 0) {
+		return TC_ACT_OK;
+	}
 
 	// edt
 	now = bpf_ktime_get_ns();
@@ -248,168 +464,175 @@ static __always_inline int global_edt(struct __sk_buff *skb, struct global_rate_
 	if (t < now)
 		t = now;
 
-	if (skb->priority == PRIO_ONLINE) {
-		delay = (__u64)ctx_wire_len(skb) * NSEC_PER_SEC / rate_info->l0_bps;
+	delay  = (__u64)ctx_wire_len(skb) * NSEC_PER_SEC / bps;
+	t_next = READ_ONCE(class->t_last) + delay;
+	if (t_next <= t) {
+		WRITE_ONCE(class->t_last, t);
+		return TC_ACT_OK;
+	}
+	ret = horizon_verdict(skb, t_next, now);
+	if (ret == TC_ACT_SHOT) {
+		return ret;
+	}
+
+	WRITE_ONCE(class->t_last, t_next);
+	skb->tstamp = t_next;
+	return ret;
+}
+#endif // FEAT_EDT
 
-		// if t_last is so big  ? ...
-		t_next = READ_ONCE(rate_info->t_l0_last) + delay;
-		if (t_next <= t) {
-			WRITE_ONCE(rate_info->t_l0_last, t);
-			return TC_ACT_OK;
-		}
-		if (t_next - now >= T_HORIZON_DROP) {
-			return TC_ACT_SHOT;
-		}
+// update_credit earn the bytes under hw_min_bps and spend the bytes over it, return the credit left
+static __always_inline __u64 update_credit(const struct global_rate_cfg *cfg, struct global_rate_info *info, __u64 avg,
+					   __u64 elapsed) {
+	__u64 max_credit = READ_ONCE(cfg->max_credit);
+	__u64 hw_min     = READ_ONCE(cfg->hw_min_bps);
+	__u64 credit     = READ_ONCE(info->credit);
+	__u64 ms         = elapsed / NSEC_PER_MSEC;
 
-		WRITE_ONCE(rate_info->t_l0_last, t_next);
-		skb->tstamp = t_next;
-	} else if (skb->priority == PRIO_OFFLINE_L1) {
-		delay  = (__u64)ctx_wire_len(skb) * NSEC_PER_SEC / rate_info->l1_bps;
-		t_next = rate_info->t_l1_last + delay;
-		if (t_next <= t) {
-			WRITE_ONCE(rate_info->t_l1_last, t);
-			return TC_ACT_OK;
-		}
-		if (t_next - now >= T_HORIZON_DROP) {
-			return TC_ACT_SHOT;
-		}
-		WRITE_ONCE(rate_info->t_l1_last, t_next);
-		skb->tstamp = t_next;
-	} else if (skb->priority == PRIO_OFFLINE_L2) {
-		delay  = (__u64)ctx_wire_len(skb) * NSEC_PER_SEC / rate_info->l2_bps;
-		t_next = rate_info->t_l2_last + delay;
-		if (t_next <= t) {
-			WRITE_ONCE(rate_info->t_l2_last, t);
-			return TC_ACT_OK;
-		}
-		if (t_next - now >= T_HORIZON_DROP) {
-			return TC_ACT_SHOT;
-		}
-		WRITE_ONCE(rate_info->t_l2_last, t_next);
-		skb->tstamp = t_next;
+	if (ms > CREDIT_MAX_ELAPSED_MS)
+		ms = CREDIT_MAX_ELAPSED_MS;
+
+	if (avg < hw_min) {
+		credit += (hw_min - avg) * ms / 1000;
+	} else {
+		__u64 spent = (avg - hw_min) * ms / 1000;
+		credit      = credit > spent ? credit - spent : 0;
 	}
+	if (credit > max_credit)
+		credit = max_credit;
 
-	return TC_ACT_OK;
+	WRITE_ONCE(info->credit, credit);
+	return credit;
 }
-#endif // FEAT_EDT
 
-static __always_inline void adjust_rate(const struct global_rate_cfg *cfg, struct global_rate_info *info, __u32 direction) {
+static __always_inline void adjust_rate(const struct global_rate_cfg *cfg, struct global_rate_info *info,
+					const struct global_key *key) {
 	__u64 overflow;
 	__u64 now;
 
-	__u64 hw_max, l0_min, l1_min, l1_max, l2_min, l2_max;
-	__u64 l0_cur, l1_cur, l2_cur;
+	__u64 hw, hw_max, min, max, cur;
 	__u64 avg;
+	__u64 interval, elapsed;
+	__u32 num;
+	int i;
 
-	now    = bpf_ktime_get_ns();
-	hw_max = READ_ONCE(cfg->hw_min_bps) / MEGABYTE;
-	l0_min = READ_ONCE(cfg->l0_min_bps) / MEGABYTE;
-	l1_min = READ_ONCE(cfg->l1_min_bps) / MEGABYTE;
-	l1_max = READ_ONCE(cfg->l1_max_bps) / MEGABYTE;
-	l2_min = READ_ONCE(cfg->l2_min_bps) / MEGABYTE;
-	l2_max = READ_ONCE(cfg->l2_max_bps) / MEGABYTE;
+	now      = bpf_ktime_get_ns();
+	interval = READ_ONCE(cfg->interval);
+	if (interval == 0)
+		interval = NSEC_PER_SEC;
 
-	l0_cur = READ_ONCE(info->l0_bps) / MEGABYTE;
-	l1_cur = READ_ONCE(info->l1_bps) / MEGABYTE;
-	l2_cur = READ_ONCE(info->l2_bps) / MEGABYTE;
+	hw     = READ_ONCE(cfg->hw_min_bps);
+	hw_max = READ_ONCE(cfg->hw_max_bps);
+	num    = READ_ONCE(cfg->class_num);
 
-	if ((now - READ_ONCE(info->t_last)) < NSEC_PER_SEC)
+	elapsed = now - READ_ONCE(info->t_last);
+	if (elapsed < interval)
 		return;
 
 	WRITE_ONCE(info->t_last, now);
 
-	avg = get_average_rate(direction) / MEGABYTE;
+	avg = get_average_rate(key);
 
-	if (avg > hw_max) {
-		overflow = avg - hw_max;
+	// burst up to hw_max_bps while the credit lasts
+	if (update_credit(cfg, info, avg, elapsed) > 0 && hw_max > hw)
+		hw = hw_max;
 
-		// suppress l2
-		if (l2_cur > l2_min) {
-			if (overflow >= (l2_cur - l2_min)) {
-				overflow -= (l2_cur - l2_min);
-				WRITE_ONCE(info->l2_bps, l2_min * MEGABYTE);
-			} else {
-				WRITE_ONCE(info->l2_bps, (l2_cur - overflow) * MEGABYTE);
-				overflow = 0;
-			}
-		} else {
-			WRITE_ONCE(info->l2_bps, l2_min * MEGABYTE);
-		}
+	if (avg > hw) {
+		overflow = avg - hw;
 
-		// suppress l1
-		if (overflow > 0) {
-			if (l1_cur > l1_min) {
-				if (overflow >= (l1_cur - l1_min)) {
-					overflow -= (l1_cur - l1_min);
-					WRITE_ONCE(info->l1_bps, l1_min * MEGABYTE);
-				} else {
-					WRITE_ONCE(info->l1_bps, (l1_cur - overflow) * MEGABYTE);
-					overflow = 0;
-				}
+		// suppress from the lowest priority, each class down to its min
+#pragma unroll
+		for (i = PRIO_NUM - 1; i >= 0; i--) {
+			if ((__u32)i >= num || overflow == 0)
+				continue;
+
+			min = READ_ONCE(cfg->classes[i].min_bps);
+			cur = READ_ONCE(info->classes[i].bps);
+			if (cur > min && cur - min > overflow) {
+				cur -= overflow;
+				overflow = 0;
 			} else {
-				WRITE_ONCE(info->l1_bps, l1_min * MEGABYTE);
+				if (cur > min)
+					overflow -= cur - min;
+				cur = min;
 			}
+			WRITE_ONCE(info->classes[i].bps, cur);
 		}
+	} else {
+		overflow = hw - avg;
 
-		// suppress online
-		if (overflow > 0) {
-			// rate_info->online_rate -= overflow;
-			if (l0_cur > l0_min) {
-				if (overflow >= (l0_cur - l0_min)) {
-					WRITE_ONCE(info->l0_bps, l0_min * MEGABYTE);
-				} else {
-					WRITE_ONCE(info->l0_bps, (l0_cur - overflow) * MEGABYTE);
-				}
+		// recover from the highest priority, each class up to its max
+#pragma unroll
+		for (i = 0; i < PRIO_NUM; i++) {
+			if ((__u32)i >= num || overflow == 0)
+				continue;
+
+			max = READ_ONCE(cfg->classes[i].max_bps);
+			cur = READ_ONCE(info->classes[i].bps);
+			if (max > cur && max - cur > overflow) {
+				cur += overflow;
+				overflow = 0;
 			} else {
-				WRITE_ONCE(info->l0_bps, l0_min * MEGABYTE);
+				if (max > cur)
+					overflow -= max - cur;
+				cur = max;
 			}
+			WRITE_ONCE(info->classes[i].bps, cur);
 		}
-	} else {
-		overflow = hw_max - avg;
-
-		if (overflow > 0) {
-			// recover online
-			if (hw_max > l0_cur) {
-				if (overflow >= (hw_max - l0_cur)) {
-					overflow -= (hw_max - l0_cur);
-					WRITE_ONCE(info->l0_bps, hw_max * MEGABYTE); // never reach here...
-				} else {
-					WRITE_ONCE(info->l0_bps, (l0_cur + overflow) * MEGABYTE); // tx-max | 7899412000000  | 100000000      | 18446744073057000000
-					overflow = 0;
-				}
-			} else {
-				WRITE_ONCE(info->l0_bps, hw_max * MEGABYTE);
-			}
+	}
+}
 
-			// recover l1
-			if (overflow > 0) {
-				if (l1_max > l1_cur) {
-					if (overflow >= (l1_max - l1_cur)) {
-						overflow -= (l1_max - l1_cur);
-						WRITE_ONCE(info->l1_bps, l1_max * MEGABYTE);
-					} else {
-						WRITE_ONCE(info->l1_bps, (l1_cur + overflow) * MEGABYTE);
-						overflow = 0;
-					}
-				} else {
-					WRITE_ONCE(info->l1_bps, l1_max * MEGABYTE);
-				}
-			}
+// l4_ports read the ports of a tcp or udp packet, return 0 if not present
+static __always_inline int l4_ports(void *l4, void *data_end, __u8 proto, __u16 *sport, __u16 *dport) {
+	if (proto != IPPROTO_TCP && proto != IPPROTO_UDP) {
+		return 0;
+	}
+	// source and dest port are the first 4 bytes of both tcp and udp
+	__u16 *ports = l4;
+	if ((void *)(ports + 2) > data_end) {
+		return 0;
+	}
+	*sport = bpf_ntohs(ports[0]);
+	*dport = bpf_ntohs(ports[1]);
+	return 1;
+}
 
-			// recover l2
-			if (overflow > 0) {
-				if (l2_max > l2_cur) {
-					if (overflow >= (l2_max - l2_cur)) {
-						WRITE_ONCE(info->l2_bps, l2_max * MEGABYTE);
-					} else {
-						WRITE_ONCE(info->l2_bps, (l2_cur + overflow) * MEGABYTE);
-					}
-				} else {
-					WRITE_ONCE(info->l2_bps, l2_max * MEGABYTE);
-				}
-			}
+// port_class return the class of the first port rule matching the packet, or the class of the pod
+static __always_inline __u32 port_class(const struct cgroup_info *info, __u8 proto, __u16 port, __u16 peer_port) {
+	struct port_class_rules *rules = bpf_map_lookup_elem(&port_class_map, &info->inode);
+	if (rules == NULL || proto == 0) {
+		return info->class_id;
+	}
+
+	int i;
+#pragma unroll
+	for (i = 0; i < PORT_RULE_NUM; i++) {
+		if ((__u32)i >= rules->num) {
+			break;
+		}
+		struct port_class_rule *rule = &rules->rules[i];
+		__u16 p                      = (rule->flags & PORT_RULE_PEER) ? peer_port : port;
+		if ((rule->protocol == 0 || rule->protocol == proto) && p >= rule->port_min && p <= rule->port_max) {
+			return rule->class_id;
 		}
 	}
+	return info->class_id;
+}
+
+// trust_dscp classify ingress packets from a trusted source by the dscp, keep the class if not mapped
+static __always_inline void trust_dscp(struct __sk_buff *skb, const struct ip_addr *saddr, __u8 dscp) {
+	struct dscp_trust_key key = {
+		.prefixlen = 128,
+		.addr      = *saddr,
+	};
+	struct dscp_trust *trust = bpf_map_lookup_elem(&dscp_trust_map, &key);
+	if (trust == NULL) {
+		return;
+	}
+	__u8 class = trust->classes[dscp & 0x3f];
+	if (class != CLASS_UNSET) {
+		skb->priority = class;
+	}
 }
 
 SEC("tc/qos_cgroup")
@@ -421,6 +644,11 @@ int qos_cgroup(struct __sk_buff *skb) {
 	void *data          = (void *)(long)skb->data;
 	struct ethhdr *l2   = data;
 	struct ip_addr addr = {0};
+	struct ip_addr peer = {0};
+	int ect             = 0;
+	__u8 dscp           = 0;
+	__u8 proto          = 0; // tcp or udp with ports, 0 for others
+	__u16 sport = 0, dport = 0;
 
 	void *data_end = (void *)(long)skb->data_end;
 	if (data + sizeof(*l2) > data_end) {
@@ -436,16 +664,21 @@ int qos_cgroup(struct __sk_buff *skb) {
 		if ((void *)(l3 + 1) > data_end) {
 			return DEFAULT_TC_ACT;
 		}
+		ect  = (l3->tos & 0x3) != 0;
+		dscp = l3->tos >> 2;
+		addr.d3 = 0xffff0000;
+		peer.d3 = 0xffff0000;
 		if (direction == INGRESS_TRAFFIC) {
-			addr.d1 = 0;
-			addr.d2 = 0;
-			addr.d3 = 0xffff0000;
 			addr.d4 = (__u32)l3->daddr;
+			peer.d4 = (__u32)l3->saddr;
 		} else {
-			addr.d1 = 0;
-			addr.d2 = 0;
-			addr.d3 = 0xffff0000;
 			addr.d4 = (__u32)l3->saddr;
+			peer.d4 = (__u32)l3->daddr;
+		}
+		// only the first fragment has the ports
+		if ((l3->frag_off & bpf_htons(0x1fff)) == 0 &&
+		    l4_ports((void *)l3 + l3->ihl * 4, data_end, l3->protocol, &sport, &dport)) {
+			proto = l3->protocol;
 		}
 
 		break;
@@ -456,17 +689,32 @@ int qos_cgroup(struct __sk_buff *skb) {
 		if ((void *)(l3 + 1) > data_end) {
 			return DEFAULT_TC_ACT;
 		}
+		// ecn is the low 2 bits of the traffic class, dscp is the high 6 bits
+		ect  = ((l3->flow_lbl[0] >> 4) & 0x3) != 0;
+		dscp = (__u8)((((__u8 *)l3)[0] & 0x0f) << 2 | l3->flow_lbl[0] >> 6);
 
 		if (direction == INGRESS_TRAFFIC) {
 			addr.d1 = (__u32)l3->daddr.in6_u.u6_addr32[0];
 			addr.d2 = (__u32)l3->daddr.in6_u.u6_addr32[1];
 			addr.d3 = (__u32)l3->daddr.in6_u.u6_addr32[2];
 			addr.d4 = (__u32)l3->daddr.in6_u.u6_addr32[3];
+			peer.d1 = (__u32)l3->saddr.in6_u.u6_addr32[0];
+			peer.d2 = (__u32)l3->saddr.in6_u.u6_addr32[1];
+			peer.d3 = (__u32)l3->saddr.in6_u.u6_addr32[2];
+			peer.d4 = (__u32)l3->saddr.in6_u.u6_addr32[3];
 		} else {
 			addr.d1 = (__u32)l3->saddr.in6_u.u6_addr32[0];
 			addr.d2 = (__u32)l3->saddr.in6_u.u6_addr32[1];
 			addr.d3 = (__u32)l3->saddr.in6_u.u6_addr32[2];
 			addr.d4 = (__u32)l3->saddr.in6_u.u6_addr32[3];
+			peer.d1 = (__u32)l3->daddr.in6_u.u6_addr32[0];
+			peer.d2 = (__u32)l3->daddr.in6_u.u6_addr32[1];
+			peer.d3 = (__u32)l3->daddr.in6_u.u6_addr32[2];
+			peer.d4 = (__u32)l3->daddr.in6_u.u6_addr32[3];
+		}
+		// extension headers are not walked
+		if (l4_ports(l3 + 1, data_end, l3->nexthdr, &sport, &dport)) {
+			proto = l3->nexthdr;
 		}
 
 		break;
@@ -475,27 +723,59 @@ int qos_cgroup(struct __sk_buff *skb) {
 		return DEFAULT_TC_ACT;
 	}
 
-	cal_rate(ctx_wire_len(skb), direction);
+	mark_ect(skb, ect && ecn_mark_enabled());
+
+	struct global_key g_key = {0};
+	const struct global_rate_cfg *g_cfg = lookup_global_cfg(skb, direction, &g_key);
+	cal_rate(ctx_wire_len(skb), &g_key, g_cfg);
 
 	const struct cgroup_info *pod_cgroup_info = NULL;
 
 	pod_cgroup_info = bpf_map_lookup_elem(&pod_map, &addr);
+#ifdef FEAT_CGROUP_ID
+	if (pod_cgroup_info == NULL) {
+		pod_cgroup_info = lookup_pod_cgroup(skb);
+	}
+#endif
 	if (pod_cgroup_info == NULL) {
 #if LINUX_VERSION_CODE >= KERNEL_VERSION(5, 10, 0)
  		// set classid as priority for host network pods
  		skb->priority = bpf_skb_cgroup_classid(skb);
 #endif
 	} else {
-		skb->priority = pod_cgroup_info->class_id;
+		if (direction == INGRESS_TRAFFIC) {
+			skb->priority = port_class(pod_cgroup_info, proto, dport, sport);
+		} else {
+			skb->priority = port_class(pod_cgroup_info, proto, sport, dport);
+		}
 
 		struct cgroup_rate_id rate_id = {0};
 		rate_id.inode                 = pod_cgroup_info->inode;
 		rate_id.direction             = direction;
 
-		struct rate_info *info = bpf_map_lookup_elem(&cgroup_rate_map, &rate_id);
-		if (info != NULL && info->bps > 0) {
-			int ret = TC_ACT_OK;
+		int ret      = TC_ACT_OK;
+		__u64 tstamp = skb->tstamp;
+
+		// a cidr rule of the peer takes precedence, 0 bps for unlimited
+		struct cidr_rate_key cidr_key = {
+			.prefixlen = CIDR_KEY_BITS,
+			.direction = direction,
+			.inode     = pod_cgroup_info->inode,
+			.addr      = peer,
+		};
+		struct rate_info *info = bpf_map_lookup_elem(&cidr_rate_map, &cidr_key);
+
+		if (info == NULL && pod_cgroup_info->network != 0) {
+			// secondary network has its own rate, fall back to the pod rate if not set
+			struct cgroup_rate_id network_id = rate_id;
+			network_id.network               = pod_cgroup_info->network;
 
+			info = bpf_map_lookup_elem(&cgroup_rate_map, &network_id);
+		}
+		if (info == NULL) {
+			info = bpf_map_lookup_elem(&cgroup_rate_map, &rate_id);
+		}
+		if (info != NULL && info->bps > 0) {
 #ifdef FEAT_EDT
 			if (direction == INGRESS_TRAFFIC) {
 				ret = tb_rate_limit(skb, info);
@@ -505,40 +785,108 @@ int qos_cgroup(struct __sk_buff *skb) {
 #else
 			ret = tb_rate_limit(skb, info);
 #endif
-			if (ret != TC_ACT_OK) {
-				return ret;
-			}
+			ret = set_ce(skb, ret);
+		}
+
+		update_stat(&cgroup_stat_map, &rate_id, ctx_wire_len(skb), ret, skb->tstamp != tstamp);
+		if (ret == QOS_ACT_MARK) {
+			ret = TC_ACT_OK;
 		}
+		if (ret != TC_ACT_OK) {
+			return ret;
+		}
+	}
+	if (direction == INGRESS_TRAFFIC) {
+		trust_dscp(skb, &peer, dscp);
 	}
 	bpf_tail_call(skb, &qos_prog_map, PROG_TC_GLOBAL);
 
 	return DEFAULT_TC_ACT;
 }
 
+// set_dscp rewrite the dscp of egress packets by the class, if the interface is configured. ECN bits are kept.
+static __always_inline void set_dscp(struct __sk_buff *skb, __u32 direction) {
+	if (direction != EGRESS_TRAFFIC) {
+		return;
+	}
+	__u32 prio = skb->priority;
+	if (prio >= PRIO_NUM) {
+		return;
+	}
+	__u32 ifindex        = skb->ifindex;
+	struct dscp_cfg *cfg = bpf_map_lookup_elem(&dscp_map, &ifindex);
+	if (cfg == NULL) {
+		return;
+	}
+	__u8 dscp = cfg->dscp[prio];
+	if (dscp == DSCP_UNSET) {
+		return;
+	}
+
+	void *data     = (void *)(long)skb->data;
+	void *data_end = (void *)(long)skb->data_end;
+	if (data + sizeof(struct ethhdr) > data_end) {
+		return;
+	}
+
+	switch (skb->protocol) {
+	case bpf_htons(ETH_P_IP): {
+		struct iphdr *l3 = data + sizeof(struct ethhdr);
+		if ((void *)(l3 + 1) > data_end) {
+			return;
+		}
+		__u8 old_tos = l3->tos;
+		__u8 new_tos = (__u8)((dscp << 2) | (old_tos & 0x3));
+		if (old_tos == new_tos) {
+			return;
+		}
+		// tos is the low byte of the first 16 bit word of the header
+		bpf_l3_csum_replace(skb, sizeof(struct ethhdr) + offsetof(struct iphdr, check), bpf_htons(old_tos),
+				    bpf_htons(new_tos), 2);
+		bpf_skb_store_bytes(skb, sizeof(struct ethhdr) + offsetof(struct iphdr, tos), &new_tos, 1, 0);
+		break;
+	}
+	case bpf_htons(ETH_P_IPV6): {
+		// traffic class is the 4th to 11th bit of the header, there is no checksum
+		__u8 *hdr = data + sizeof(struct ethhdr);
+		if ((void *)(hdr + sizeof(struct ipv6hdr)) > data_end) {
+			return;
+		}
+		hdr[0] = (__u8)((hdr[0] & 0xf0) | (dscp >> 2));
+		hdr[1] = (__u8)((hdr[1] & 0x3f) | ((dscp & 0x3) << 6));
+		break;
+	}
+	}
+}
+
 SEC("tc/qos_global")
 int qos_global(struct __sk_buff *skb) {
 	struct global_rate_cfg *g_cfg   = NULL;
 	struct global_rate_info *g_info = NULL;
 	int ret                         = TC_ACT_OK;
 	__u32 direction                 = get_direction(skb);
+	__u64 tstamp                    = skb->tstamp;
+	struct global_key g_key         = {0};
+
+	// the dscp is marked by the class even without a global config
+	set_dscp(skb, direction);
 
 	// load current level rate info
-	g_cfg = bpf_map_lookup_elem(&terway_global_cfg, &direction);
+	g_cfg = lookup_global_cfg(skb, direction, &g_key);
 	if (g_cfg == NULL)
 		return DEFAULT_TC_ACT;
 
-	g_info = bpf_map_lookup_elem(&global_rate_map, &direction);
+	g_info = bpf_map_lookup_elem(&global_rate_map, &g_key);
 	if (g_info == NULL) {
-		g_info = &(struct global_rate_info){
-			.t_last    = bpf_ktime_get_ns(),
-			.t_l0_last = 0,
-			.l0_bps    = g_cfg->hw_min_bps,
-			.t_l1_last = 0,
-			.l1_bps    = g_cfg->l1_max_bps,
-			.t_l2_last = 0,
-			.l2_bps    = g_cfg->l2_max_bps,
-		};
-		bpf_map_update_elem(&global_rate_map, &direction, g_info, BPF_NOEXIST);
+		struct global_rate_info init = {0};
+		int i;
+
+		init.t_last = bpf_ktime_get_ns();
+#pragma unroll
+		for (i = 0; i < PRIO_NUM; i++) {
+			init.classes[i].bps = g_cfg->classes[i].max_bps;
+		}
+		bpf_map_update_elem(&global_rate_map, &g_key, &init, BPF_NOEXIST);
 		return DEFAULT_TC_ACT;
 	}
 
@@ -555,11 +903,24 @@ int qos_global(struct __sk_buff *skb) {
 #else
 	ret = global_tb_rate_limit(skb, g_info);
 #endif
+	ret = set_ce(skb, ret);
+
+	if (skb->priority < PRIO_NUM) {
+		struct class_stat_id stat_id = {
+			.class_id  = skb->priority,
+			.direction = direction,
+		};
 
+		update_stat(&class_stat_map, &stat_id, ctx_wire_len(skb), ret, skb->tstamp != tstamp);
+	}
+
+	if (ret == QOS_ACT_MARK) {
+		ret = TC_ACT_OK;
+	}
 	if (ret != TC_ACT_OK) {
 		return ret;
 	}
-	adjust_rate(g_cfg, g_info, direction);
+	adjust_rate(g_cfg, g_info, &g_key);
 
 	return DEFAULT_TC_ACT;
 }
@@ -12,14 +12,20 @@
 #define NSEC_PER_MSEC (1000 * 1000ULL)
 
 #define T_HORIZON_DROP (2000 * 1000 * 1000ULL)
+// in ecn mark mode, ECT packets over the horizon are marked instead, until they are this far ahead
+#define T_HORIZON_MARK (2 * T_HORIZON_DROP)
 
-#define MEGABYTE (1000 * 1000ULL)
+// credit is not earned or spent for longer than this, in case the rate is not adjusted for long
+#define CREDIT_MAX_ELAPSED_MS (3600 * 1000ULL)
+
+// a GSO packet up to 64KiB must fit in the bucket
+#define MIN_BURST (64 * 1024ULL)
 
 #define MAX_PROG 30
 
-#define PRIO_ONLINE 0
-#define PRIO_OFFLINE_L1 1
-#define PRIO_OFFLINE_L2 2
+// max number of priority classes, the smaller the higher priority, class 0 is the online class.
+// The number in use is global_rate_cfg.class_num
+#define PRIO_NUM 8
 
 #define INGRESS_TRAFFIC 0
 #define EGRESS_TRAFFIC 1
@@ -29,40 +35,51 @@
 
 #define DEFAULT_TC_ACT TC_ACT_PIPE
 
+// internal verdict, the packet is passed with CE marked
+#define QOS_ACT_MARK 0x100
+
+// mark ECT packets with CE instead of dropping
+#define QOS_OPT_ECN_MARK (1 << 0)
+
 struct rate_info {
 	__u64 bps;
 	__u64 t_last;
 	__u64 slot3;
+	__u64 burst; // bucket size in bytes, 0 for one second of traffic
+};
+
+struct class_cfg {
+	__u64 min_bps;
+	__u64 max_bps;
 };
 
 struct global_rate_cfg {
-	__u64 interval; // the interval to adjust rate
-	__u64 hw_min_bps;
-	__u64 hw_max_bps;
+	__u64 interval;   // the interval to adjust rate
+	__u64 hw_min_bps; // the guaranteed host bandwidth
+	__u64 hw_max_bps; // the host bandwidth while there is credit
+	__u64 max_credit; // max bytes of credit, 0 to disable bursting over hw_min_bps
 
-	__u64 l0_min_bps;
-	__u64 l0_max_bps;
+	__u32 estimator;  // ESTIMATOR_WINDOW or ESTIMATOR_EWMA
+	__u32 slot_num;   // slots of the window, at most EST_SLOT_MAX
+	__u64 slot_width; // ns, the throughput is estimated every slot
+	__u64 half_life;  // ns, of the ewma
 
-	__u64 l1_min_bps;
-	__u64 l1_max_bps;
-	__u64 l2_min_bps;
-	__u64 l2_max_bps;
+	__u32 class_num; // classes in use, at most PRIO_NUM
+	__u32 pad;
+	struct class_cfg classes[PRIO_NUM]; // index by priority
 };
 
-struct global_rate_info {
+struct class_rate {
 	__u64 t_last;
+	__u64 bps;
+	__u64 slot;
+};
 
-	__u64 t_l0_last;
-	__u64 l0_bps;
-	__u64 l0_slot;
-
-	__u64 t_l1_last;
-	__u64 l1_bps;
-	__u64 l1_slot;
+struct global_rate_info {
+	__u64 t_last;
+	__u64 credit; // bytes earned under hw_min_bps, spent over it
 
-	__u64 t_l2_last;
-	__u64 l2_bps;
-	__u64 l2_slot;
+	struct class_rate classes[PRIO_NUM]; // index by priority
 };
 
 struct ip_addr {
@@ -74,20 +91,125 @@ struct ip_addr {
 
 struct cgroup_info {
 	__u32 class_id; // cgroup classid
-	__u32 pad1;
-	__u64 inode; // cgroup inode id
+	__u32 network;  // network of the address, 0 for the default network
+	__u64 inode;    // cgroup inode id
 };
 
 struct cgroup_rate_id {
 	__u64 inode;
 	__u32 direction;
+	__u32 network; // rate of a secondary network, 0 for the whole pod
+};
+
+// direction and inode are always matched, the rest is the prefix of the peer address
+#define CIDR_KEY_PREFIX (32 + 64)
+#define CIDR_KEY_BITS (CIDR_KEY_PREFIX + 128)
+
+struct cidr_rate_key {
+	__u32 prefixlen;
+	__u32 direction;
+	__u64 inode;
+	struct ip_addr addr; // the peer, ipv4 is mapped to ipv6
+};
+
+// max number of port rules of a pod
+#define PORT_RULE_NUM 16
+// match the port of the peer instead of the pod
+#define PORT_RULE_PEER (1 << 0)
+
+struct port_class_rule {
+	__u8 protocol; // IPPROTO_TCP or IPPROTO_UDP, 0 for both
+	__u8 flags;    // PORT_RULE_*
+	__u16 class_id;
+	__u16 port_min; // host byte order
+	__u16 port_max;
+};
+
+struct port_class_rules {
+	__u32 num; // rules in use, the first match wins
 	__u32 pad;
+	struct port_class_rule rules[PORT_RULE_NUM];
 };
 
-struct net_stat {
-	__u64 index;
+// the class is not marked
+#define DSCP_UNSET 0xff
+
+struct dscp_cfg {
+	__u8 dscp[PRIO_NUM]; // index by priority, DSCP_UNSET to keep the dscp of the packet
+};
+
+// the dscp is not mapped to a class
+#define CLASS_UNSET 0xff
+
+struct dscp_trust_key {
+	__u32 prefixlen;
+	struct ip_addr addr; // the source, ipv4 is mapped to ipv6
+};
+
+struct dscp_trust {
+	__u8 classes[64]; // index by dscp, CLASS_UNSET to keep the class of the pod
+};
+
+// the bytes counted by each cpu are flushed to the shared net_stat at most this late
+#define NET_STAT_FLUSH_NS (1 * NSEC_PER_MSEC)
+
+// the throughput is estimated every slot, over a window of slots or by ewma
+#define ESTIMATOR_WINDOW 0
+#define ESTIMATOR_EWMA 1
+
+#define EST_SLOT_MAX 16
+#define EST_SLOT_NUM_DEFAULT 10
+#define EST_SLOT_WIDTH_DEFAULT (100 * NSEC_PER_MSEC)
+
+struct net_stat_slot {
 	__u64 ts;
-	__u64 val;
+	__u64 bytes;
+};
+
+// net_stat is the bytes of an interface, flushed by all cpus atomically
+struct net_stat {
+	__u64 bytes;    // total bytes flushed, only added atomically
+	__u64 ts;       // the last slot estimated
+	__u64 ts_bytes; // bytes at ts
+	__u64 rate;     // bytes/s estimated
+
+	struct net_stat_slot slots[EST_SLOT_MAX]; // snapshots of the window estimator, index by time
+};
+
+// net_stat_pcpu is the bytes counted by a cpu, not flushed yet
+struct net_stat_pcpu {
+	__u64 pending;
+	__u64 t_flush;
+};
+
+// global_key index the global config, rate and throughput of an interface.
+// ifindex 0 is the default, shared by interfaces without their own config.
+struct global_key {
+	__u32 ifindex;
+	__u32 direction;
+};
+
+#define GLOBAL_KEY_NUM (256 * 2)
+
+struct qos_stat {
+	__u64 pass_bytes;
+	__u64 pass_packets;
+	__u64 drop_bytes;
+	__u64 drop_packets;
+	__u64 delay_bytes;
+	__u64 delay_packets;
+	__u64 mark_bytes;
+	__u64 mark_packets;
+};
+
+struct class_stat_id {
+	__u32 class_id;
+	__u32 direction;
+};
+
+struct qos_opts {
+	__u32 flags; // QOS_OPT_*
+	__u32 pad;
 };
 
 /* Global map to jump into terway qos program */
@@ -117,32 +239,130 @@ struct {
 	__uint(max_entries, 65535);
 	__uint(pinning, LIBBPF_PIN_BY_NAME);
 } cgroup_rate_map SEC(".maps");
+
+/* rate of the pod to or from the peers in a cidr, longest prefix match by pod inode + direction + peer */
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(key_size, sizeof(struct cidr_rate_key));
+	__uint(value_size, sizeof(struct rate_info));
+	__uint(max_entries, 65535);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} cidr_rate_map SEC(".maps");
+
+/* class of the pod traffic by protocol and port, index by pod inode */
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(key_size, sizeof(__u64));
+	__uint(value_size, sizeof(struct port_class_rules));
+	__uint(max_entries, 65535);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} port_class_map SEC(".maps");
+
+// the deepest cgroup level a pod cgroup is looked up, e.g. kubepods.slice/kubepods-burstable.slice/<pod> is 3
+#define CGROUP_LEVEL_MAX 6
+
+/* Global map for host network pod config on cgroup v2, index by the cgroup id of the pod */
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(key_size, sizeof(__u64));
+	__uint(value_size, sizeof(struct cgroup_info));
+	__uint(max_entries, 65535);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} cgroup_info_map SEC(".maps");
 /* per pod rate limit end */
 
 /* global rate limit begin */
 struct {
-	__uint(type, BPF_MAP_TYPE_ARRAY);
-	__uint(key_size, sizeof(__u32));
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(key_size, sizeof(struct global_key));
 	__uint(value_size, sizeof(struct global_rate_cfg));
-	__uint(max_entries, 2);
+	__uint(max_entries, GLOBAL_KEY_NUM);
 	__uint(pinning, LIBBPF_PIN_BY_NAME);
 } terway_global_cfg SEC(".maps");
 
 struct {
-	__uint(type, BPF_MAP_TYPE_ARRAY);
-	__uint(key_size, sizeof(__u32));
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(key_size, sizeof(struct global_key));
 	__uint(value_size, sizeof(struct global_rate_info));
-	__uint(max_entries, 2);
+	__uint(max_entries, GLOBAL_KEY_NUM);
 	__uint(pinning, LIBBPF_PIN_BY_NAME);
 } global_rate_map SEC(".maps");
 /* global rate limit end*/
 
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(key_size, sizeof(struct global_key));
+	__uint(value_size, sizeof(struct net_stat));
+	__uint(max_entries, GLOBAL_KEY_NUM);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} terway_net_stat SEC(".maps");
+
+// a zero net_stat to init the entry, which is too large for the stack
 struct {
 	__uint(type, BPF_MAP_TYPE_ARRAY);
 	__uint(key_size, sizeof(__u32));
 	__uint(value_size, sizeof(struct net_stat));
-	__uint(max_entries, 20);
+	__uint(max_entries, 1);
+} net_stat_zero SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+	__uint(key_size, sizeof(struct global_key));
+	__uint(value_size, sizeof(struct net_stat_pcpu));
+	__uint(max_entries, GLOBAL_KEY_NUM);
 	__uint(pinning, LIBBPF_PIN_BY_NAME);
-} terway_net_stat SEC(".maps");
+} net_stat_pcpu_map SEC(".maps");
+
+/* datapath options, single entry */
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(key_size, sizeof(__u32));
+	__uint(value_size, sizeof(struct qos_opts));
+	__uint(max_entries, 1);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} qos_opts_map SEC(".maps");
+
+/* dscp of each class on egress, index by ifindex. Interfaces absent are not marked */
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(key_size, sizeof(__u32));
+	__uint(value_size, sizeof(struct dscp_cfg));
+	__uint(max_entries, 256);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} dscp_map SEC(".maps");
+
+/* class of ingress packets by dscp, longest prefix match by the trusted source */
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(key_size, sizeof(struct dscp_trust_key));
+	__uint(value_size, sizeof(struct dscp_trust));
+	__uint(max_entries, 1024);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} dscp_trust_map SEC(".maps");
+
+/* per cpu counters begin */
+
+/* index by cgroup inode + direction */
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+	__uint(key_size, sizeof(struct cgroup_rate_id));
+	__uint(value_size, sizeof(struct qos_stat));
+	__uint(max_entries, 65535);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} cgroup_stat_map SEC(".maps");
+
+/* index by priority class + direction */
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+	__uint(key_size, sizeof(struct class_stat_id));
+	__uint(value_size, sizeof(struct qos_stat));
+	__uint(max_entries, 64);
+	__uint(pinning, LIBBPF_PIN_BY_NAME);
+} class_stat_map SEC(".maps");
+/* per cpu counters end */
 
 #endif /* __RATE_LIMIT_TC__ */
\ No newline at end of file
@@ -18,6 +18,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"sort"
 
 	"github.com/AliyunContainerService/terway-qos/pkg/bpf"
 
@@ -34,44 +35,62 @@ var bpfBandwidthListCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		defer writer.Close()
-		ing, eg, err := writer.GetGlobalConfig()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error get global config %v", err)
-			os.Exit(1)
-		}
-		err = pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
-			{"config", "l0", "l1", "l2"},
-			{"rx-max", fmt.Sprintf("%d", ing.HwGuaranteed), fmt.Sprintf("%d", ing.L1MaxBps), fmt.Sprintf("%d", ing.L2MaxBps)},
-			{"rx-min", fmt.Sprintf("%d", ing.L0MinBps), fmt.Sprintf("%d", ing.L1MinBps), fmt.Sprintf("%d", ing.L2MinBps)},
-			{"tx-max", fmt.Sprintf("%d", eg.HwGuaranteed), fmt.Sprintf("%d", eg.L1MaxBps), fmt.Sprintf("%d", eg.L2MaxBps)},
-			{"tx-min", fmt.Sprintf("%d", eg.L0MinBps), fmt.Sprintf("%d", eg.L1MinBps), fmt.Sprintf("%d", eg.L2MinBps)},
-		}).Render()
+		configs, err := writer.ListGlobalConfig()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error get global config %v", err)
 			os.Exit(1)
 		}
 
-		ingRate, egressRate := writer.GetGlobalRateLimit()
-		_ = pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
-			{"limit", "L0", "L1", "L2"},
-			{"tx-max", fmt.Sprintf("%d", egressRate.L0Bps), fmt.Sprintf("%d", egressRate.L1Bps), fmt.Sprintf("%d", egressRate.L2Bps)},
-			{"t_last", fmt.Sprintf("%d", egressRate.L0LastTimestamp), fmt.Sprintf("%d", egressRate.L1LastTimestamp), fmt.Sprintf("%d", egressRate.L2LastTimestamp)},
-			{"slot", fmt.Sprintf("%d", egressRate.L0Slot), fmt.Sprintf("%d", egressRate.L1Slot), fmt.Sprintf("%d", egressRate.L2Slot)},
-		}).Render()
+		for _, ifindex := range sortedIfindex(configs) {
+			ing, eg := configs[ifindex].Ingress, configs[ifindex].Egress
+			rxThroughput, txThroughput := writer.GetInterfaceThroughput(ifindex)
+
+			fmt.Printf("interface: %s\n", interfaceName(ifindex))
+			fmt.Printf("interval: rx %s tx %s\n", ing.Interval, eg.Interval)
+			fmt.Printf("estimator: rx %s tx %s\n", &ing.Estimator, &eg.Estimator)
+			fmt.Printf("throughput: rx %d tx %d\n", rxThroughput, txThroughput)
+			n := max(len(ing.Classes), len(eg.Classes))
+			err = pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
+				classHeader("config", n),
+				classRow("rx-max", n, func(i int) uint64 { return classOf(ing, i).MaxBps }),
+				classRow("rx-min", n, func(i int) uint64 { return classOf(ing, i).MinBps }),
+				classRow("tx-max", n, func(i int) uint64 { return classOf(eg, i).MaxBps }),
+				classRow("tx-min", n, func(i int) uint64 { return classOf(eg, i).MinBps }),
+			}).Render()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error get global config %v", err)
+				os.Exit(1)
+			}
 
-		_ = pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
-			{"limit", "L0", "L1", "L2"},
-			{"rx-max", fmt.Sprintf("%d", ingRate.L0Bps), fmt.Sprintf("%d", ingRate.L1Bps), fmt.Sprintf("%d", ingRate.L2Bps)},
-			{"t_last", fmt.Sprintf("%d", ingRate.L0LastTimestamp), fmt.Sprintf("%d", ingRate.L1LastTimestamp), fmt.Sprintf("%d", ingRate.L2LastTimestamp)},
-			{"slot", fmt.Sprintf("%d", ingRate.L0Slot), fmt.Sprintf("%d", ingRate.L1Slot), fmt.Sprintf("%d", ingRate.L2Slot)},
-		}).Render()
+			ingRate, egressRate := writer.GetInterfaceRateLimit(ifindex)
+			_ = pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
+				classHeader("limit", n),
+				classRow("tx-max", n, func(i int) uint64 { return egressRate.Classes[i].Bps }),
+				classRow("t_last", n, func(i int) uint64 { return egressRate.Classes[i].LastTimestamp }),
+				classRow("slot", n, func(i int) uint64 { return egressRate.Classes[i].Slot }),
+			}).Render()
 
-		data := [][]string{
-			{"stat", "index", "ts", "val"},
+			_ = pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
+				classHeader("limit", n),
+				classRow("rx-max", n, func(i int) uint64 { return ingRate.Classes[i].Bps }),
+				classRow("t_last", n, func(i int) uint64 { return ingRate.Classes[i].LastTimestamp }),
+				classRow("slot", n, func(i int) uint64 { return ingRate.Classes[i].Slot }),
+			}).Render()
 		}
-		for _, v := range writer.GetNetStat() {
-			data = append(data, []string{"", fmt.Sprintf("%d", v.Index), fmt.Sprintf("%d", v.TS), fmt.Sprintf("%d", v.Val)})
+
+		pending := writer.GetPendingBytes()
+		var rows [][]string
+		for key, v := range writer.GetNetStat() {
+			rows = append(rows, []string{"", interfaceName(key.Ifindex), bpf.DirectionName(key.Direction),
+				fmt.Sprintf("%d", v.Bytes), fmt.Sprintf("%d", pending[key]), fmt.Sprintf("%d", v.TS), fmt.Sprintf("%d", v.Rate)})
 		}
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i][1] != rows[j][1] {
+				return rows[i][1] < rows[j][1]
+			}
+			return rows[i][2] < rows[j][2]
+		})
+		data := append([][]string{{"stat", "interface", "direction", "bytes", "pending", "ts", "rate"}}, rows...)
 		_ = pterm.DefaultTable.WithHasHeader().WithData(data).Render()
 
 	},
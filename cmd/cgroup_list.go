@@ -46,13 +46,53 @@ func cgroupList() error {
 	defer writer.Close()
 
 	tableData := pterm.TableData{
-		{"inode", "direction", "rate"},
+		{"inode", "direction", "rate", "burst"},
 	}
 	for k, v := range writer.ListCgroupRate() {
-		tableData = append(tableData, []string{fmt.Sprintf("%d", k.Inode), fmt.Sprintf("%d", k.Direction), fmt.Sprintf("%d", v.LimitBps)})
+		tableData = append(tableData, []string{fmt.Sprintf("%d", k.Inode), fmt.Sprintf("%d", k.Direction), fmt.Sprintf("%d", v.LimitBps), fmt.Sprintf("%d", v.Burst)})
 	}
 
-	return pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+	err = pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
+	if err != nil {
+		return err
+	}
+
+	cidrData := pterm.TableData{
+		{"inode", "direction", "cidr", "rate"},
+	}
+	for k, v := range writer.ListCIDRRate() {
+		cidrData = append(cidrData, []string{fmt.Sprintf("%d", k.Inode), fmt.Sprintf("%d", k.Direction), k.CIDR().String(), fmt.Sprintf("%d", v.LimitBps)})
+	}
+
+	err = pterm.DefaultTable.WithHasHeader().WithData(cidrData).Render()
+	if err != nil {
+		return err
+	}
+
+	portData := pterm.TableData{
+		{"inode", "protocol", "port", "peer", "class_id"},
+	}
+	for k, v := range writer.ListPortClass() {
+		for _, rule := range v.Rules[:v.Num] {
+			portData = append(portData, []string{fmt.Sprintf("%d", k), fmt.Sprintf("%d", rule.Protocol),
+				fmt.Sprintf("%d-%d", rule.PortMin, rule.PortMax), fmt.Sprintf("%t", rule.Flags != 0), fmt.Sprintf("%d", rule.ClassID)})
+		}
+	}
+
+	err = pterm.DefaultTable.WithHasHeader().WithData(portData).Render()
+	if err != nil {
+		return err
+	}
+
+	// host network pods on cgroup v2
+	infoData := pterm.TableData{
+		{"cgroup_id", "class_id"},
+	}
+	for k, v := range writer.ListCgroupInfo() {
+		infoData = append(infoData, []string{fmt.Sprintf("%d", k), fmt.Sprintf("%d", v.ClassID)})
+	}
+
+	return pterm.DefaultTable.WithHasHeader().WithData(infoData).Render()
 }
 
 func init() {
@@ -17,13 +17,17 @@ package cmd
 
 import (
 	"fmt"
+	"net"
+	"sort"
 	"time"
 
+	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
 	"github.com/AliyunContainerService/terway-qos/pkg/bpf"
 	"github.com/AliyunContainerService/terway-qos/pkg/types"
 
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
 var direction string
@@ -33,27 +37,45 @@ var (
 	cgroupPath string
 	ipv4       string
 	ipv6       string
-	rate       uint64 // bytes/s
+	rate       bandwidth.Bps
+	burst      bandwidth.Bps
 	priority   int
 )
 
 var (
-	hwRxGuaranteedRate uint64
-	hwTxGuaranteedRate uint64
+	hwRxGuaranteedRate bandwidth.Bps
+	hwTxGuaranteedRate bandwidth.Bps
 
-	adjustInterval uint64
+	hwRxBurstableRate bandwidth.Bps
+	hwTxBurstableRate bandwidth.Bps
+	hwRxBurstCredit   bandwidth.Bps
+	hwTxBurstCredit   bandwidth.Bps
 
-	l1RxMaxRate uint64
-	l1RxMinRate uint64
+	estimator types.RateEstimator
 
-	l1TxMaxRate uint64
-	l1TxMinRate uint64
+	adjustInterval time.Duration
 
-	l2RxMaxRate uint64
-	l2RxMinRate uint64
+	l0RxMaxRate bandwidth.Bps
+	l0RxMinRate bandwidth.Bps
 
-	l2TxMaxRate uint64
-	l2TxMinRate uint64
+	l0TxMaxRate bandwidth.Bps
+	l0TxMinRate bandwidth.Bps
+
+	l1RxMaxRate bandwidth.Bps
+	l1RxMinRate bandwidth.Bps
+
+	l1TxMaxRate bandwidth.Bps
+	l1TxMinRate bandwidth.Bps
+
+	l2RxMaxRate bandwidth.Bps
+	l2RxMinRate bandwidth.Bps
+
+	l2TxMaxRate bandwidth.Bps
+	l2TxMinRate bandwidth.Bps
+
+	// rxClasses and txClasses set the min and max of any class, e.g. L3=10M,100M
+	rxClasses []string
+	txClasses []string
 )
 
 // configCmd represents the config command
@@ -70,29 +92,52 @@ var globalCmd = &cobra.Command{
 var globalSetCmd = &cobra.Command{
 	Use: "set",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		writer, err := bpf.NewMap()
+		egress := &types.GlobalConfig{
+			Interval:       adjustInterval,
+			HwGuaranteed:   uint64(hwTxGuaranteedRate),
+			HwBurstableBps: uint64(hwTxBurstableRate),
+			BurstCredit:    uint64(hwTxBurstCredit),
+			Estimator:      estimator,
+			Classes: []types.ClassConfig{
+				{MinBps: uint64(l0TxMinRate), MaxBps: uint64(l0TxMaxRate)},
+				{MinBps: uint64(l1TxMinRate), MaxBps: uint64(l1TxMaxRate)},
+				{MinBps: uint64(l2TxMinRate), MaxBps: uint64(l2TxMaxRate)},
+			},
+		}
+		ingress := &types.GlobalConfig{
+			Interval:       adjustInterval,
+			HwGuaranteed:   uint64(hwRxGuaranteedRate),
+			HwBurstableBps: uint64(hwRxBurstableRate),
+			BurstCredit:    uint64(hwRxBurstCredit),
+			Estimator:      estimator,
+			Classes: []types.ClassConfig{
+				{MinBps: uint64(l0RxMinRate), MaxBps: uint64(l0RxMaxRate)},
+				{MinBps: uint64(l1RxMinRate), MaxBps: uint64(l1RxMaxRate)},
+				{MinBps: uint64(l2RxMinRate), MaxBps: uint64(l2RxMaxRate)},
+			},
+		}
+		err := setClassRates(ingress, rxClasses)
 		if err != nil {
 			return err
 		}
-		defer writer.Close()
-
-		egress := &types.GlobalConfig{
-			HwGuaranteed:   hwTxGuaranteedRate,
-			HwBurstableBps: hwTxGuaranteedRate,
-			L1MaxBps:       l1TxMaxRate,
-			L1MinBps:       l1TxMinRate,
-			L2MaxBps:       l2TxMaxRate,
-			L2MinBps:       l2TxMinRate,
+		err = setClassRates(egress, txClasses)
+		if err != nil {
+			return err
 		}
-		ingress := &types.GlobalConfig{
-			HwGuaranteed:   hwRxGuaranteedRate,
-			HwBurstableBps: hwRxGuaranteedRate,
-			L1MaxBps:       l1RxMaxRate,
-			L1MinBps:       l1RxMinRate,
-			L2MaxBps:       l2RxMaxRate,
-			L2MinBps:       l2RxMinRate,
+		ingress.Default()
+		egress.Default()
+		errs := ingress.Validate(field.NewPath("ingress"))
+		errs = append(errs, egress.Validate(field.NewPath("egress"))...)
+		if len(errs) > 0 {
+			return errs.ToAggregate()
 		}
 
+		writer, err := bpf.NewMap()
+		if err != nil {
+			return err
+		}
+		defer writer.Close()
+
 		err = writer.WriteGlobalConfig(ingress, egress)
 		if err != nil {
 			return err
@@ -110,18 +155,30 @@ var globalGetCmd = &cobra.Command{
 			return err
 		}
 		defer writer.Close()
-		ing, eg, err := writer.GetGlobalConfig()
+		configs, err := writer.ListGlobalConfig()
 		if err != nil {
 			return err
 		}
 
-		return pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
-			{"", "L0", "L1", "L2"},
-			{"Rx-Max", fmt.Sprintf("%d", ing.HwGuaranteed), fmt.Sprintf("%d", ing.L1MaxBps), fmt.Sprintf("%d", ing.L2MaxBps)},
-			{"Rx-Min", fmt.Sprintf("%d", ing.L0MinBps), fmt.Sprintf("%d", ing.L1MinBps), fmt.Sprintf("%d", ing.L2MinBps)},
-			{"Tx-Max", fmt.Sprintf("%d", eg.HwGuaranteed), fmt.Sprintf("%d", eg.L1MaxBps), fmt.Sprintf("%d", eg.L2MaxBps)},
-			{"Tx-Min", fmt.Sprintf("%d", eg.L0MinBps), fmt.Sprintf("%d", eg.L1MinBps), fmt.Sprintf("%d", eg.L2MinBps)},
-		}).Render()
+		for _, ifindex := range sortedIfindex(configs) {
+			ing, eg := configs[ifindex].Ingress, configs[ifindex].Egress
+			fmt.Printf("Interface: %s\n", interfaceName(ifindex))
+			fmt.Printf("Interval: rx %s tx %s\n", ing.Interval, eg.Interval)
+			fmt.Printf("Estimator: rx %s tx %s\n", &ing.Estimator, &eg.Estimator)
+			fmt.Printf("Burstable: rx %d tx %d, burst credit: rx %d tx %d\n", ing.HwBurstableBps, eg.HwBurstableBps, ing.BurstCredit, eg.BurstCredit)
+			n := max(len(ing.Classes), len(eg.Classes))
+			err = pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
+				classHeader("", n),
+				classRow("Rx-Max", n, func(i int) uint64 { return classOf(ing, i).MaxBps }),
+				classRow("Rx-Min", n, func(i int) uint64 { return classOf(ing, i).MinBps }),
+				classRow("Tx-Max", n, func(i int) uint64 { return classOf(eg, i).MaxBps }),
+				classRow("Tx-Min", n, func(i int) uint64 { return classOf(eg, i).MinBps }),
+			}).Render()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	},
 }
 
@@ -133,38 +190,123 @@ var globalRateCetCmd = &cobra.Command{
 			return err
 		}
 		defer writer.Close()
-		_, eg := writer.GetGlobalRateLimit()
+		configs, err := writer.ListGlobalConfig()
 		if err != nil {
 			return err
 		}
 
-		return pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
-			{"", "L0", "L1", "L2"},
-			{"Tx-Max", fmt.Sprintf("%d", eg.L0Bps), fmt.Sprintf("%d", eg.L1Bps), fmt.Sprintf("%d", eg.L2Bps)},
-			{"last", fmt.Sprintf("%d", eg.L0LastTimestamp), fmt.Sprintf("%d", eg.L1LastTimestamp), fmt.Sprintf("%d", eg.L2LastTimestamp)},
-			{"start", fmt.Sprintf("%d", eg.LastTimestamp), fmt.Sprintf("%d", eg.LastTimestamp), fmt.Sprintf("%d", eg.LastTimestamp)},
-		}).Render()
+		for _, ifindex := range sortedIfindex(configs) {
+			egCfg := configs[ifindex].Egress
+			_, eg := writer.GetInterfaceRateLimit(ifindex)
+
+			fmt.Printf("Interface: %s\n", interfaceName(ifindex))
+			fmt.Printf("Credit: tx %d/%d\n", eg.Credit, egCfg.BurstCredit)
+			n := len(egCfg.Classes)
+			err = pterm.DefaultTable.WithHasHeader().WithData(pterm.TableData{
+				classHeader("", n),
+				classRow("Tx-Max", n, func(i int) uint64 { return eg.Classes[i].Bps }),
+				classRow("last", n, func(i int) uint64 { return eg.Classes[i].LastTimestamp }),
+				classRow("start", n, func(i int) uint64 { return eg.LastTimestamp }),
+			}).Render()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	},
 }
 
+// sortedIfindex return the interfaces configured, the global limit first
+// setClassRates set the min and max of classes like L3=10M,100M, classes are extended if needed
+func setClassRates(c *types.GlobalConfig, rates []string) error {
+	for _, r := range rates {
+		prio, class, err := types.ParseClassRate(r)
+		if err != nil {
+			return err
+		}
+		*c.Class(int(prio)) = class
+	}
+	return nil
+}
+
+func sortedIfindex(configs map[uint32]*types.InterfaceConfig) []uint32 {
+	result := make([]uint32, 0, len(configs))
+	for ifindex := range configs {
+		result = append(result, ifindex)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// interfaceName return the name of the interface, ifindex 0 is the global limit shared by the others
+func interfaceName(ifindex uint32) string {
+	if ifindex == 0 {
+		return "default"
+	}
+	link, err := net.InterfaceByIndex(int(ifindex))
+	if err != nil {
+		return fmt.Sprintf("ifindex %d", ifindex)
+	}
+	return fmt.Sprintf("%s(%d)", link.Name, ifindex)
+}
+
+// classHeader return the header of a table with a column for each class
+func classHeader(name string, n int) []string {
+	row := []string{name}
+	for i := 0; i < n; i++ {
+		row = append(row, fmt.Sprintf("L%d", i))
+	}
+	return row
+}
+
+func classRow(name string, n int, val func(i int) uint64) []string {
+	row := []string{name}
+	for i := 0; i < n; i++ {
+		row = append(row, fmt.Sprintf("%d", val(i)))
+	}
+	return row
+}
+
+// classOf return the class config, zero if the class is not configured
+func classOf(c *types.GlobalConfig, prio int) types.ClassConfig {
+	if prio < len(c.Classes) {
+		return c.Classes[prio]
+	}
+	return types.ClassConfig{}
+}
+
 func init() {
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(globalRateCetCmd)
 	configCmd.AddCommand(podCmd, globalCmd)
 
 	globalCmd.AddCommand(globalSetCmd, globalGetCmd)
-	globalSetCmd.PersistentFlags().Uint64Var(&adjustInterval, "interval", uint64(1*time.Second), "interval to adjust bandwidth")
-	globalSetCmd.PersistentFlags().Uint64Var(&hwRxGuaranteedRate, "hw-rx", 0, "")
-	globalSetCmd.PersistentFlags().Uint64Var(&hwTxGuaranteedRate, "hw-tx", 0, "")
-	globalSetCmd.PersistentFlags().Uint64Var(&l1TxMaxRate, "l1-tx-max", 0, "")
-	globalSetCmd.PersistentFlags().Uint64Var(&l1TxMinRate, "l1-tx-min", 0, "")
-	globalSetCmd.PersistentFlags().Uint64Var(&l2TxMaxRate, "l2-tx-max", 0, "")
-	globalSetCmd.PersistentFlags().Uint64Var(&l2TxMinRate, "l2-tx-min", 0, "")
-
-	globalSetCmd.PersistentFlags().Uint64Var(&l1RxMaxRate, "l1-rx-max", 0, "")
-	globalSetCmd.PersistentFlags().Uint64Var(&l1RxMinRate, "l1-rx-min", 0, "")
-	globalSetCmd.PersistentFlags().Uint64Var(&l2RxMaxRate, "l2-rx-max", 0, "")
-	globalSetCmd.PersistentFlags().Uint64Var(&l2RxMinRate, "l2-rx-min", 0, "")
+	globalSetCmd.PersistentFlags().DurationVar(&adjustInterval, "interval", types.DefaultAdjustInterval, "interval to adjust bandwidth, at least 100ms")
+	globalSetCmd.PersistentFlags().StringVar(&estimator.Type, "estimator", types.EstimatorWindow, "estimator of the throughput, window or ewma")
+	globalSetCmd.PersistentFlags().DurationVar(&estimator.SlotWidth, "slot-width", types.DefaultSlotWidth, "interval to estimate the throughput, 10ms to 1s")
+	globalSetCmd.PersistentFlags().Uint32Var(&estimator.SlotNum, "slot-num", types.DefaultSlotNum, "slots of the window estimator, at most 16")
+	globalSetCmd.PersistentFlags().DurationVar(&estimator.HalfLife, "half-life", types.DefaultHalfLife, "half-life of the ewma estimator, at least 10ms")
+	globalSetCmd.PersistentFlags().Var(&hwRxGuaranteedRate, "hw-rx", "bytes/s, units like 100M, 1Gbit, 125MB/s, 10Mi are accepted")
+	globalSetCmd.PersistentFlags().Var(&hwTxGuaranteedRate, "hw-tx", "bytes/s, units like 100M, 1Gbit, 125MB/s, 10Mi are accepted")
+	globalSetCmd.PersistentFlags().Var(&hwRxBurstableRate, "hw-rx-burstable", "bytes/s, rx bandwidth while there is burst credit, hw-rx if not set")
+	globalSetCmd.PersistentFlags().Var(&hwTxBurstableRate, "hw-tx-burstable", "bytes/s, tx bandwidth while there is burst credit, hw-tx if not set")
+	globalSetCmd.PersistentFlags().Var(&hwRxBurstCredit, "hw-rx-burst-credit", "bytes earned under hw-rx to burst up to hw-rx-burstable, 0 to disable")
+	globalSetCmd.PersistentFlags().Var(&hwTxBurstCredit, "hw-tx-burst-credit", "bytes earned under hw-tx to burst up to hw-tx-burstable, 0 to disable")
+	globalSetCmd.PersistentFlags().Var(&l0TxMaxRate, "l0-tx-max", "bytes/s, hw-tx if not set")
+	globalSetCmd.PersistentFlags().Var(&l0TxMinRate, "l0-tx-min", "bytes/s, hw-tx minus min of other classes if not set")
+	globalSetCmd.PersistentFlags().Var(&l1TxMaxRate, "l1-tx-max", "bytes/s, units like 100M, 1Gbit, 125MB/s, 10Mi are accepted")
+	globalSetCmd.PersistentFlags().Var(&l1TxMinRate, "l1-tx-min", "bytes/s, units like 100M, 1Gbit, 125MB/s, 10Mi are accepted")
+	globalSetCmd.PersistentFlags().Var(&l2TxMaxRate, "l2-tx-max", "bytes/s, units like 100M, 1Gbit, 125MB/s, 10Mi are accepted")
+	globalSetCmd.PersistentFlags().Var(&l2TxMinRate, "l2-tx-min", "bytes/s, units like 100M, 1Gbit, 125MB/s, 10Mi are accepted")
+
+	globalSetCmd.PersistentFlags().Var(&l0RxMaxRate, "l0-rx-max", "bytes/s, hw-rx if not set")
+	globalSetCmd.PersistentFlags().Var(&l0RxMinRate, "l0-rx-min", "bytes/s, hw-rx minus min of other classes if not set")
+	globalSetCmd.PersistentFlags().Var(&l1RxMaxRate, "l1-rx-max", "bytes/s, units like 100M, 1Gbit, 125MB/s, 10Mi are accepted")
+	globalSetCmd.PersistentFlags().Var(&l1RxMinRate, "l1-rx-min", "bytes/s, units like 100M, 1Gbit, 125MB/s, 10Mi are accepted")
+	globalSetCmd.PersistentFlags().Var(&l2RxMaxRate, "l2-rx-max", "bytes/s, units like 100M, 1Gbit, 125MB/s, 10Mi are accepted")
+	globalSetCmd.PersistentFlags().Var(&l2RxMinRate, "l2-rx-min", "bytes/s, units like 100M, 1Gbit, 125MB/s, 10Mi are accepted")
+	globalSetCmd.PersistentFlags().StringArrayVar(&rxClasses, "rx-class", nil, "<class>=<min>,<max> of any class up to L7, e.g. L3=10M,100M, repeatable")
+	globalSetCmd.PersistentFlags().StringArrayVar(&txClasses, "tx-class", nil, "<class>=<min>,<max> of any class up to L7, e.g. L3=10M,100M, repeatable")
 
 	_ = globalSetCmd.MarkPersistentFlagRequired("hw-rx")
 	_ = globalSetCmd.MarkPersistentFlagRequired("hw-tx")
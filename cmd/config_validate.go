@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
+	"github.com/AliyunContainerService/terway-qos/pkg/config"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var linkBps bandwidth.Bps
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate <file>",
+	Short: "validate a global config file without touching bpf maps",
+	Long: `validate a global config file without touching bpf maps.
+The format is detected by extension, .yaml/.yml/.json for structured config, others for the key-value config.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		errs, err := validateGlobalConfig(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error read config %v\n", err)
+			os.Exit(1)
+		}
+		if len(errs) > 0 {
+			for _, e := range errs {
+				fmt.Fprintln(os.Stderr, e.Error())
+			}
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", args[0])
+	},
+}
+
+func validateGlobalConfig(path string) (field.ErrorList, error) {
+	ingress, egress, err := config.GetGlobalConfig(path, uint64(linkBps))
+	if err != nil {
+		return nil, err
+	}
+
+	ingress.Default()
+	egress.Default()
+	errs := ingress.Validate(field.NewPath("ingress"))
+	errs = append(errs, egress.Validate(field.NewPath("egress"))...)
+
+	// the link speed of each interface is unknown offline, percentages are relative to link-bps as well
+	interfaces, err := config.GetInterfaceConfigs(path, func(string) uint64 { return uint64(linkBps) })
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(interfaces))
+	for name := range interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cfg := interfaces[name]
+		cfg.Ingress.Default()
+		cfg.Egress.Default()
+		fldPath := field.NewPath("interfaces").Key(name)
+		errs = append(errs, cfg.Ingress.Validate(fldPath.Child("ingress"))...)
+		errs = append(errs, cfg.Egress.Validate(fldPath.Child("egress"))...)
+	}
+	return errs, nil
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+
+	configValidateCmd.Flags().Var(&linkBps, "link-bps", "link capacity used when hw bps is absent, e.g. 10Gbit")
+}
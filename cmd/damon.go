@@ -18,6 +18,7 @@ package cmd
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 
 	"github.com/spf13/pflag"
@@ -28,6 +29,8 @@ import (
 	"github.com/AliyunContainerService/terway-qos/pkg/bpf"
 	"github.com/AliyunContainerService/terway-qos/pkg/config"
 	"github.com/AliyunContainerService/terway-qos/pkg/k8s"
+	"github.com/AliyunContainerService/terway-qos/pkg/metrics"
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
 	"github.com/AliyunContainerService/terway-qos/pkg/version"
 
 	"github.com/spf13/cobra"
@@ -41,6 +44,14 @@ const (
 	enableEgress      = "enable-egress"
 	excludeInterfaces = "exclude-interfaces"
 	bpfPrio           = "bpf-prio"
+	metricsAddr       = "metrics-bind-address"
+	nodeQoSConfig     = "enable-node-qos-config"
+	congestionAction  = "congestion-action"
+	qosClassNames     = "qos-class-names"
+	dscpInterfaces    = "dscp-interfaces"
+	dscpClasses       = "dscp-classes"
+	dscpTrustCIDRs    = "dscp-trust-cidrs"
+	dscpTrustClasses  = "dscp-trust-classes"
 )
 
 func init() {
@@ -50,6 +61,15 @@ func init() {
 	fs.Bool(enableEgress, false, "enable egress direction qos")
 	fs.StringSlice(excludeInterfaces, []string{}, "network interface names to exclude")
 	fs.Int(bpfPrio, 90, "tc prio for the qos program")
+	fs.String(metricsAddr, ":9099", "address the prometheus metrics endpoint binds to, set empty to disable")
+	fs.Bool(nodeQoSConfig, false, "watch NodeQoSConfig for the global config, ignored if the CRD is not installed")
+	fs.String(congestionAction, bpf.CongestionActionDrop, "action for packets over the limit, drop or mark. mark set CE on ECT packets instead of dropping them")
+	fs.StringToString(qosClassNames, nil, "map the k8s.aliyun.com/qos-class annotation to the priority class, e.g. gold=0,silver=3. guaranteed=0,burstable=1,best-effort=2 are kept unless overridden")
+
+	fs.StringSlice(dscpInterfaces, []string{}, "network interface names to mark the dscp of egress packets by the class, e.g. the underlay nics")
+	fs.StringToString(dscpClasses, nil, "dscp of each class on the dscp interfaces, e.g. L0=AF41,L2=CS1. Classes absent keep the dscp of the packets")
+	fs.StringSlice(dscpTrustCIDRs, []string{}, "trusted source cidrs, ingress packets from them are classified by the dscp")
+	fs.StringToString(dscpTrustClasses, nil, "class of each dscp for the trusted sources, e.g. AF41=L0,CS1=L2. Other dscp keep the class of the pod")
 
 	_ = viper.BindPFlags(fs)
 	pflag.CommandLine.AddFlagSet(fs)
@@ -77,10 +97,20 @@ func daemon() error {
 	ctx := ctrl.SetupSignalHandler()
 	ctrl.SetLogger(klogr.New())
 
+	classNames, err := k8s.ParseClassNames(viper.GetStringMapString(qosClassNames))
+	if err != nil {
+		return err
+	}
+
 	mgr, err := bpf.NewBpfMgr(viper.GetBool(enableIngress), viper.GetBool(enableEgress), viper.GetBool(enableBPFCORE), validDevice, viper.GetInt(bpfPrio))
 	if err != nil {
 		return err
 	}
+	dscp, err := bpf.ParseDSCPClasses(viper.GetStringMapString(dscpClasses))
+	if err != nil {
+		return err
+	}
+	mgr.SetDSCPMarking(viper.GetStringSlice(dscpInterfaces), dscp)
 	err = mgr.Start(ctx)
 	if err != nil {
 		return err
@@ -91,12 +121,58 @@ func daemon() error {
 	}
 	defer m.Close()
 
-	syncer := config.NewSyncer(m)
+	action := viper.GetString(congestionAction)
+	if action == bpf.CongestionActionMark && !bpf.ECNSupported() {
+		klog.Warningf("ecn mark is not supported by the datapath, packets over the limit are dropped")
+	}
+	err = m.SetCongestionAction(action)
+	if err != nil {
+		return err
+	}
+
+	trustCIDRs, err := parseCIDRs(viper.GetStringSlice(dscpTrustCIDRs))
+	if err != nil {
+		return err
+	}
+	trustClasses, err := bpf.ParseDSCPTrustClasses(viper.GetStringMapString(dscpTrustClasses))
+	if err != nil {
+		return err
+	}
+	err = m.SetDSCPTrust(trustCIDRs, trustClasses)
+	if err != nil {
+		return err
+	}
+
+	syncer := config.NewSyncer(m, mgr.LinkBps, mgr.LinkSpeed)
 	err = syncer.Start(ctx)
 	if err != nil {
 		return err
 	}
-	return k8s.StartPodHandler(ctx, syncer)
+
+	if addr := viper.GetString(metricsAddr); addr != "" {
+		metrics.Registry.MustRegister(metrics.NewCollector(m, syncer))
+		err = metrics.Serve(ctx, addr)
+		if err != nil {
+			return err
+		}
+	}
+	var global types.SyncGlobal
+	if viper.GetBool(nodeQoSConfig) {
+		global = syncer
+	}
+	return k8s.StartPodHandler(ctx, syncer, syncer, global, classNames)
+}
+
+func parseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	var result []netip.Prefix
+	for _, s := range cidrs {
+		cidr, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q, %w", s, err)
+		}
+		result = append(result, cidr)
+	}
+	return result, nil
 }
 
 func validDevice(link netlink.Link) bool {
@@ -46,10 +46,10 @@ func podList() error {
 	defer writer.Close()
 
 	tableData := pterm.TableData{
-		{"ip", "class_id", "inode"},
+		{"ip", "class_id", "network", "inode"},
 	}
 	for k, v := range writer.ListPodInfo() {
-		tableData = append(tableData, []string{k.String(), fmt.Sprintf("%d", v.ClassID), fmt.Sprintf("%d", v.Inode)})
+		tableData = append(tableData, []string{k.String(), fmt.Sprintf("%d", v.ClassID), fmt.Sprintf("%d", v.Network), fmt.Sprintf("%d", v.Inode)})
 	}
 
 	return pterm.DefaultTable.WithHasHeader().WithData(tableData).Render()
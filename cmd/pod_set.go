@@ -20,6 +20,7 @@ import (
 	"net/netip"
 	"os"
 
+	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
 	"github.com/AliyunContainerService/terway-qos/pkg/bpf"
 	"github.com/AliyunContainerService/terway-qos/pkg/types"
 
@@ -42,18 +43,19 @@ func podSet() error {
 		return fmt.Errorf("ip must provided")
 	}
 	var err error
-	var v4, v6 netip.Addr
-	if ipv4 != "" {
-		v4, err = netip.ParseAddr(ipv4)
-		if err != nil {
-			return err
+	var ips []types.PodIP
+	for _, ip := range []string{ipv4, ipv6} {
+		if ip == "" {
+			continue
 		}
-	}
-	if ipv6 != "" {
-		v6, err = netip.ParseAddr(ipv6)
+		addr, err := netip.ParseAddr(ip)
 		if err != nil {
 			return err
 		}
+		ips = append(ips, types.PodIP{Addr: addr})
+	}
+	if err = bandwidth.ValidateBurst(uint64(burst)); err != nil {
+		return err
 	}
 	writer, err := bpf.NewMap()
 	if err != nil {
@@ -62,15 +64,16 @@ func podSet() error {
 	defer writer.Close()
 
 	unSet := uint64(0)
+	tx := uint64(rate)
 	return writer.WritePodInfo(&types.PodConfig{
 		PodID:       "",
 		PodUID:      "",
-		IPv4:        v4,
-		IPv6:        v6,
+		IPs:         ips,
 		HostNetwork: false,
 		CgroupInfo:  nil,
 		RxBps:       &unSet,
-		TxBps:       &rate,
+		TxBps:       &tx,
+		TxBurst:     uint64(burst),
 	})
 }
 
@@ -81,8 +84,9 @@ func init() {
 	podCmd.PersistentFlags().StringVar(&cgroupPath, "cgroup", "", "cgroup path.")
 	podCmd.PersistentFlags().StringVar(&ipv4, "ipv4", "", "ipv4 addr")
 	podCmd.PersistentFlags().StringVar(&ipv6, "ipv6", "", "ipv6 addr")
-	podCmd.PersistentFlags().Uint64Var(&rate, "rate", 0, "rate limit. bytes/s. At lease 1 MB/s, set 0 to disable rate limit")
-	podCmd.PersistentFlags().IntVar(&priority, "prio", 0, "priority. 0,1,2")
+	podCmd.PersistentFlags().Var(&rate, "rate", "rate limit. bytes/s, units like 100M, 1Gbit are accepted. set 0 to disable rate limit")
+	podCmd.PersistentFlags().Var(&burst, "burst", "bucket size in bytes, units like 64Ki, 1M are accepted. At least 64KiB, 0 for one second of traffic")
+	podCmd.PersistentFlags().IntVar(&priority, "prio", 0, "priority class, 0 to 7")
 
 	_ = podSetCmd.MarkPersistentFlagRequired("cgroup")
 	_ = podSetCmd.MarkPersistentFlagRequired("rate")
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/bpf"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "show packets passed, dropped and delayed by qos",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error read bpf map %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func stats() error {
+	writer, err := bpf.NewMap()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	ips := map[uint64][]string{}
+	for ip, info := range writer.ListPodInfo() {
+		ips[info.Inode] = append(ips[info.Inode], ip.String())
+	}
+
+	podData := pterm.TableData{
+		{"inode", "ip", "direction", "pass_bytes", "pass_pkts", "drop_bytes", "drop_pkts", "delay_bytes", "delay_pkts", "mark_bytes", "mark_pkts"},
+	}
+	for k, v := range writer.ListCgroupStat() {
+		sort.Strings(ips[k.Inode])
+		podData = append(podData, []string{
+			fmt.Sprintf("%d", k.Inode), strings.Join(ips[k.Inode], ","), bpf.DirectionName(k.Direction),
+			fmt.Sprintf("%d", v.PassBytes), fmt.Sprintf("%d", v.PassPackets),
+			fmt.Sprintf("%d", v.DropBytes), fmt.Sprintf("%d", v.DropPackets),
+			fmt.Sprintf("%d", v.DelayBytes), fmt.Sprintf("%d", v.DelayPackets),
+			fmt.Sprintf("%d", v.MarkBytes), fmt.Sprintf("%d", v.MarkPackets),
+		})
+	}
+	err = pterm.DefaultTable.WithHasHeader().WithData(podData).Render()
+	if err != nil {
+		return err
+	}
+
+	classData := pterm.TableData{
+		{"class", "direction", "pass_bytes", "pass_pkts", "drop_bytes", "drop_pkts", "delay_bytes", "delay_pkts", "mark_bytes", "mark_pkts"},
+	}
+	for k, v := range writer.ListClassStat() {
+		classData = append(classData, []string{
+			fmt.Sprintf("L%d", k.ClassID), bpf.DirectionName(k.Direction),
+			fmt.Sprintf("%d", v.PassBytes), fmt.Sprintf("%d", v.PassPackets),
+			fmt.Sprintf("%d", v.DropBytes), fmt.Sprintf("%d", v.DropPackets),
+			fmt.Sprintf("%d", v.DelayBytes), fmt.Sprintf("%d", v.DelayPackets),
+			fmt.Sprintf("%d", v.MarkBytes), fmt.Sprintf("%d", v.MarkPackets),
+		})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(classData).Render()
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+}
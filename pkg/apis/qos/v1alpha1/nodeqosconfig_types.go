@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
+)
+
+// ClassConfig is the bandwidth of a priority class, in bytes/s
+type ClassConfig struct {
+	// +kubebuilder:validation:XIntOrString
+	MinBps bandwidth.Bps `json:"minBps,omitempty"`
+	// +kubebuilder:validation:XIntOrString
+	MaxBps bandwidth.Bps `json:"maxBps,omitempty"`
+}
+
+// DirectionConfig is the config of a traffic direction
+type DirectionConfig struct {
+	// HwBps is the host bandwidth, in bytes/s
+	// +kubebuilder:validation:XIntOrString
+	HwBps bandwidth.Bps `json:"hwBps,omitempty"`
+	// HwBurstableBps is the host bandwidth while there is burst credit, in bytes/s, HwBps if not set
+	// +kubebuilder:validation:XIntOrString
+	HwBurstableBps bandwidth.Bps `json:"hwBurstableBps,omitempty"`
+	// BurstCredit is the max bytes earned under HwBps, and spent to burst up to HwBurstableBps. 0 to disable bursting
+	// +kubebuilder:validation:XIntOrString
+	BurstCredit bandwidth.Bps `json:"burstCredit,omitempty"`
+
+	// L0 online class, min defaults to the bandwidth left by the other classes
+	L0 ClassConfig `json:"l0,omitempty"`
+	// L1 offline class
+	L1 ClassConfig `json:"l1,omitempty"`
+	// L2 offline class
+	L2 ClassConfig `json:"l2,omitempty"`
+	// Classes of lower priority than L2, the first one is L3
+	// +kubebuilder:validation:MaxItems=5
+	Classes []ClassConfig `json:"classes,omitempty"`
+}
+
+// NodeQoSConfigSpec defines the desired state of NodeQoSConfig
+type NodeQoSConfigSpec struct {
+	// NodeSelector select nodes the config applied to, an empty selector select all nodes
+	NodeSelector metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	// Priority decide which config is applied when several configs select the same node.
+	// The higher one wins, and the name in alphabetical order breaks a tie.
+	Priority int32 `json:"priority,omitempty"`
+
+	// AdjustInterval is the interval to adjust rate of each class, default 1s, at least 100ms
+	AdjustInterval *metav1.Duration `json:"adjustInterval,omitempty"`
+
+	Ingress DirectionConfig `json:"ingress,omitempty"`
+	Egress  DirectionConfig `json:"egress,omitempty"`
+}
+
+// NodeStatus is reported by the daemon on each node applying the config, or failed to apply it
+type NodeStatus struct {
+	NodeName string `json:"nodeName"`
+
+	// Applied is true when the config is written to the datapath of the node
+	Applied bool `json:"applied"`
+
+	// ObservedGeneration is the generation handled by the node
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Message is the validation error, or why the config is not applied
+	Message string `json:"message,omitempty"`
+
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// NodeQoSConfigStatus defines the observed state of NodeQoSConfig
+type NodeQoSConfigStatus struct {
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+
+// NodeQoSConfig is the global bandwidth config of selected nodes.
+// It takes precedence over the config file in /var/lib/terway/qos.
+type NodeQoSConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NodeQoSConfigSpec   `json:"spec,omitempty"`
+	Status NodeQoSConfigStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// NodeQoSConfigList contains a list of NodeQoSConfig
+type NodeQoSConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NodeQoSConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NodeQoSConfig{}, &NodeQoSConfigList{})
+}
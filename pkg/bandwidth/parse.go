@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bandwidth
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var bpsRe = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([kKMGT]i?)?(B|B/s|bit|bit/s)?$`)
+
+var prefixes = map[string]int64{
+	"":   1,
+	"k":  1000,
+	"K":  1000,
+	"M":  1000 * 1000,
+	"G":  1000 * 1000 * 1000,
+	"T":  1000 * 1000 * 1000 * 1000,
+	"ki": 1 << 10,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// ParseBps parse bandwidth to bytes/s, which is the canonical unit in terway-qos.
+//
+// A plain number is bytes/s. It can be followed by a decimal(k, M, G, T) or binary(Ki, Mi, Gi, Ti) prefix,
+// and a unit of B, B/s(bytes) or bit, bit/s(bits). The unit defaults to bytes.
+// e.g. 125000000, 125M, 125MB/s, 1Gbit, 10Mi
+func ParseBps(s string) (uint64, error) {
+	group := bpsRe.FindStringSubmatch(strings.TrimSpace(s))
+	if group == nil {
+		return 0, fmt.Errorf("invalid bandwidth %q, expect a number with an optional unit like 100M, 1Gbit, 125MB/s, 10Mi", s)
+	}
+
+	v, ok := new(big.Rat).SetString(group[1])
+	if !ok {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	v.Mul(v, new(big.Rat).SetInt64(prefixes[group[2]]))
+	if strings.HasPrefix(group[3], "bit") {
+		v.Quo(v, big.NewRat(8, 1))
+	}
+
+	// round down to whole bytes
+	result := new(big.Int).Quo(v.Num(), v.Denom())
+	if !result.IsUint64() {
+		return 0, fmt.Errorf("bandwidth %q overflow", s)
+	}
+	return result.Uint64(), nil
+}
+
+// Bps is bandwidth in bytes/s.
+// It can be used as a flag, and decoded from a json number or string accepted by ParseBps.
+type Bps uint64
+
+func (b Bps) String() string {
+	return strconv.FormatUint(uint64(b), 10)
+}
+
+func (b *Bps) Set(s string) error {
+	v, err := ParseBps(s)
+	if err != nil {
+		return err
+	}
+	*b = Bps(v)
+	return nil
+}
+
+func (b *Bps) Type() string {
+	return "bandwidth"
+}
+
+func (b *Bps) UnmarshalJSON(data []byte) error {
+	s, err := jsonString(data)
+	if err != nil {
+		return err
+	}
+	return b.Set(s)
+}
+
+// MinBurst is the minimum burst size in bytes, a GSO packet up to 64KiB must fit in the bucket
+const MinBurst = 64 * 1024
+
+// ParseBurst parse burst size in bytes, in the format accepted by ParseBps.
+// 0 means the default, which is one second of traffic.
+func ParseBurst(s string) (uint64, error) {
+	v, err := ParseBps(s)
+	if err != nil {
+		return 0, err
+	}
+	if err = ValidateBurst(v); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
+
+// ValidateBurst check burst is either 0 or at least MinBurst
+func ValidateBurst(burst uint64) error {
+	if burst != 0 && burst < MinBurst {
+		return fmt.Errorf("burst %d is too small, expect 0 or at least %d bytes", burst, MinBurst)
+	}
+	return nil
+}
+
+// jsonString decode a json string or number as string
+func jsonString(data []byte) (string, error) {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		err := json.Unmarshal(data, &s)
+		return s, err
+	}
+	var n json.Number
+	err := json.Unmarshal(data, &n)
+	return n.String(), err
+}
+
+// Limit is bandwidth in bytes/s, or a percentage of the host bandwidth, e.g. 100M, 20%
+type Limit struct {
+	Bps     uint64
+	Percent float64
+}
+
+// ParseLimit parse bandwidth accepted by ParseBps, or a percentage between 0 and 100
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if v, ok := strings.CutSuffix(s, "%"); ok {
+		p, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || p < 0 || p > 100 {
+			return Limit{}, fmt.Errorf("invalid percentage %q, expect 0%% to 100%%", s)
+		}
+		return Limit{Percent: p}, nil
+	}
+	v, err := ParseBps(s)
+	if err != nil {
+		return Limit{}, err
+	}
+	return Limit{Bps: v}, nil
+}
+
+// IsPercent return true if the limit is relative to the host bandwidth
+func (l Limit) IsPercent() bool {
+	return l.Percent > 0
+}
+
+// Value return the limit in bytes/s, hw is the host bandwidth
+func (l Limit) Value(hw uint64) uint64 {
+	if l.IsPercent() {
+		return uint64(float64(hw) * l.Percent / 100)
+	}
+	return l.Bps
+}
+
+func (l Limit) String() string {
+	if l.IsPercent() {
+		return strconv.FormatFloat(l.Percent, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatUint(l.Bps, 10)
+}
+
+func (l *Limit) UnmarshalJSON(data []byte) error {
+	s, err := jsonString(data)
+	if err != nil {
+		return err
+	}
+	v, err := ParseLimit(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
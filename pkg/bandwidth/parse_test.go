@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bandwidth
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseBps(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "125000000", want: 125000000},
+		{in: "100M", want: 100000000},
+		{in: "100k", want: 100000},
+		{in: "125MB/s", want: 125000000},
+		{in: "125MB", want: 125000000},
+		{in: "1Gbit", want: 125000000},
+		{in: "1Gbit/s", want: 125000000},
+		{in: "10Mi", want: 10 * 1024 * 1024},
+		{in: "10MiB/s", want: 10 * 1024 * 1024},
+		{in: "1.5G", want: 1500000000},
+		{in: " 8bit ", want: 1},
+		{in: "", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "100m", wantErr: true},
+		{in: "10 Mbps", wantErr: true},
+		{in: "100000000T", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseBps(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBps() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseBps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBpsUnmarshalJSON(t *testing.T) {
+	var v struct {
+		A Bps `json:"a"`
+		B Bps `json:"b"`
+	}
+	err := json.Unmarshal([]byte(`{"a": 100, "b": "1Gbit"}`), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.A != 100 || v.B != 125000000 {
+		t.Errorf("Unmarshal() = %v", v)
+	}
+
+	err = json.Unmarshal([]byte(`{"a": "1x"}`), &v)
+	if err == nil {
+		t.Error("Unmarshal() expect error")
+	}
+}
+
+func TestParseBurst(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "64Ki", want: MinBurst},
+		{in: "10M", want: 10000000},
+		{in: "1500", wantErr: true},
+		{in: "1x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseBurst(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBurst() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseBurst() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Limit
+		value   uint64
+		wantErr bool
+	}{
+		{in: "100M", want: Limit{Bps: 100000000}, value: 100000000},
+		{in: "20%", want: Limit{Percent: 20}, value: 200},
+		{in: "12.5 %", want: Limit{Percent: 12.5}, value: 125},
+		{in: "0%", want: Limit{}, value: 0},
+		{in: "101%", wantErr: true},
+		{in: "-1%", wantErr: true},
+		{in: "x%", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLimit(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLimit() = %v, want %v", got, tt.want)
+			}
+			if got.Value(1000) != tt.value {
+				t.Errorf("Value() = %v, want %v", got.Value(1000), tt.value)
+			}
+		})
+	}
+}
@@ -18,48 +18,68 @@ package bandwidth
 
 import (
 	"fmt"
-
-	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-var minRsrc = resource.MustParse("1k")
-var maxRsrc = resource.MustParse("1P")
+const (
+	minBps = 1000
+	maxBps = 1000 * 1000 * 1000 * 1000 * 1000
+)
 
-func validateBandwidthIsReasonable(rsrc *resource.Quantity) error {
-	if rsrc.Value() < minRsrc.Value() {
-		return fmt.Errorf("resource is unreasonably small (< 1kbit)")
+func validateBandwidthIsReasonable(bps uint64) error {
+	if bps < minBps {
+		return fmt.Errorf("bandwidth %d is unreasonably small (< %d)", bps, uint64(minBps))
 	}
-	if rsrc.Value() > maxRsrc.Value() {
-		return fmt.Errorf("resource is unreasonably large (> 1Pbit)")
+	if bps > maxBps {
+		return fmt.Errorf("bandwidth %d is unreasonably large (> %d)", bps, uint64(maxBps))
 	}
 	return nil
 }
 
-// ExtractPodBandwidthResources extracts the ingress and egress from the given pod annotations
-func ExtractPodBandwidthResources(podAnnotations map[string]string) (ingress, egress *resource.Quantity, err error) {
-	if podAnnotations == nil {
-		return nil, nil, nil
-	}
+// ExtractPodBandwidthResources extracts the ingress and egress bytes/s from the given pod annotations, in the format
+// accepted by ParseBps. nil if not set.
+func ExtractPodBandwidthResources(podAnnotations map[string]string) (ingress, egress *uint64, err error) {
 	str, found := podAnnotations["kubernetes.io/ingress-bandwidth"]
 	if found {
-		ingressValue, err := resource.ParseQuantity(str)
+		ingress, err = parseReasonableBps(str)
 		if err != nil {
 			return nil, nil, err
 		}
-		ingress = &ingressValue
-		if err := validateBandwidthIsReasonable(ingress); err != nil {
-			return nil, nil, err
-		}
 	}
 	str, found = podAnnotations["kubernetes.io/egress-bandwidth"]
 	if found {
-		egressValue, err := resource.ParseQuantity(str)
+		egress, err = parseReasonableBps(str)
 		if err != nil {
 			return nil, nil, err
 		}
-		egress = &egressValue
-		if err := validateBandwidthIsReasonable(egress); err != nil {
-			return nil, nil, err
+	}
+	return ingress, egress, nil
+}
+
+func parseReasonableBps(s string) (*uint64, error) {
+	v, err := ParseBps(s)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateBandwidthIsReasonable(v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// ExtractPodBurst extracts the ingress and egress burst size in bytes from the given pod annotations, 0 if not set
+func ExtractPodBurst(podAnnotations map[string]string) (ingress, egress uint64, err error) {
+	str, found := podAnnotations["k8s.aliyun.com/ingress-burst"]
+	if found {
+		ingress, err = ParseBurst(str)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	str, found = podAnnotations["k8s.aliyun.com/egress-burst"]
+	if found {
+		egress, err = ParseBurst(str)
+		if err != nil {
+			return 0, 0, err
 		}
 	}
 	return ingress, egress, nil
@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bandwidth
+
+import (
+	"testing"
+)
+
+func TestExtractPodBandwidthResources(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ingress     uint64
+		egress      uint64
+		wantErr     bool
+	}{
+		{name: "not set"},
+		{name: "quantity", annotations: map[string]string{"kubernetes.io/ingress-bandwidth": "10M", "kubernetes.io/egress-bandwidth": "10Mi"}, ingress: 10000000, egress: 10 * 1024 * 1024},
+		{name: "unit", annotations: map[string]string{"kubernetes.io/egress-bandwidth": "1Gbit"}, egress: 125000000},
+		{name: "invalid", annotations: map[string]string{"kubernetes.io/ingress-bandwidth": "10 Mbps"}, wantErr: true},
+		{name: "too small", annotations: map[string]string{"kubernetes.io/egress-bandwidth": "8bit"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingress, egress, err := ExtractPodBandwidthResources(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractPodBandwidthResources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			value := func(v *uint64) uint64 {
+				if v == nil {
+					return 0
+				}
+				return *v
+			}
+			if value(ingress) != tt.ingress || value(egress) != tt.egress {
+				t.Errorf("ExtractPodBandwidthResources() = %d, %d, want %d, %d", value(ingress), value(egress), tt.ingress, tt.egress)
+			}
+		})
+	}
+}
@@ -29,12 +29,15 @@ const (
 
 var standardCFlags = []string{"-O2", "-target", "bpf", "-std=gnu99"}
 
-func Compile(enableEDT bool) error {
+func Compile(enableEDT, enableCgroupID bool) error {
 	custom := map[string]string{}
 
 	if enableEDT {
 		custom["FEAT_EDT"] = "1"
 	}
+	if enableCgroupID {
+		custom["FEAT_CGROUP_ID"] = "1"
+	}
 
 	return compile(progName, custom)
 }
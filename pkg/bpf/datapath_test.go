@@ -0,0 +1,440 @@
+//go:build privileged_tests
+
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/rlimit"
+	"golang.org/x/sys/unix"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+// datapath tests run the programs by BPF_PROG_TEST_RUN, run by `make test-datapath` as root
+
+const (
+	tcActShot = 2
+
+	cbIngress = 0x8
+
+	packetSize = 1500
+)
+
+// skbContext is the head of struct __sk_buff, which can be set by BPF_PROG_TEST_RUN
+type skbContext struct {
+	Len            uint32
+	PktType        uint32
+	Mark           uint32
+	QueueMapping   uint32
+	Protocol       uint32
+	VlanPresent    uint32
+	VlanTCI        uint32
+	VlanProto      uint32
+	Priority       uint32
+	IngressIfindex uint32
+	Ifindex        uint32
+	TCIndex        uint32
+	CB             [5]uint32
+}
+
+// loadDatapath load the programs with private maps, the pinned maps of the node are untouched
+func loadDatapath(t testing.TB) *qos_tcObjects {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("datapath tests require root")
+	}
+	if err := rlimit.RemoveMemlock(); err != nil {
+		t.Fatal(err)
+	}
+	spec, err := loadQos_tc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range spec.Maps {
+		m.Pinning = ebpf.PinNone
+	}
+	objs := &qos_tcObjects{}
+	if err = spec.LoadAndAssign(objs, nil); err != nil {
+		t.Fatalf("load objects failed, run make generate if the bpf source is changed, %v", err)
+	}
+	t.Cleanup(func() { _ = objs.Close() })
+	return objs
+}
+
+// ipv4Packet build a udp packet of packetSize bytes to dst
+func ipv4Packet(dst netip.Addr) []byte {
+	pkt := make([]byte, packetSize)
+	// ethernet
+	binary.BigEndian.PutUint16(pkt[12:], unix.ETH_P_IP)
+	// ipv4
+	ip := pkt[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], packetSize-14)
+	ip[8] = 64
+	ip[9] = unix.IPPROTO_UDP
+	copy(ip[12:16], netip.MustParseAddr("10.0.0.1").AsSlice())
+	copy(ip[16:20], dst.AsSlice())
+	return pkt
+}
+
+// sendUntil run prog with packets of offered bytes, return the bytes passed and the time taken
+func sendUntil(t *testing.T, prog *ebpf.Program, pkt []byte, ctx *skbContext, offered uint64) (uint64, time.Duration) {
+	t.Helper()
+	passed := uint64(0)
+	start := time.Now()
+	for sent := uint64(0); sent < offered; sent += uint64(len(pkt)) {
+		ret, err := prog.Run(&ebpf.RunOptions{Data: pkt, Context: ctx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret != tcActShot {
+			passed += uint64(len(pkt))
+		}
+	}
+	return passed, time.Since(start)
+}
+
+// checkRate expect the passed bytes is a full bucket plus the refill during elapsed
+func checkRate(t *testing.T, bps, burst, passed uint64, elapsed time.Duration) {
+	t.Helper()
+	refill := bps * uint64(elapsed.Microseconds()) / 1000000
+	if passed+packetSize < burst || passed > burst+refill+packetSize {
+		t.Errorf("passed %d bytes in %s at %d bytes/s, want %d to %d", passed, elapsed, bps, burst, burst+refill)
+	}
+}
+
+func TestDatapathPodRate(t *testing.T) {
+	objs := loadDatapath(t)
+	w := &Writer{obj: objs}
+	dst := netip.MustParseAddr("192.168.0.10")
+
+	for i, bps := range []uint64{4 * 1024, 256 * 1000, 2 * 1000 * 1000} {
+		inode := uint64(i + 1)
+		err := w.WritePodInfo(&types.PodConfig{
+			IPs:        []types.PodIP{{Addr: dst}},
+			CgroupInfo: &types.CgroupInfo{Inode: inode},
+			RxBps:      &bps,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the bucket is at least 64KiB, so the default one second burst of small limits is larger
+		burst := bps
+		if burst < 64*1024 {
+			burst = 64 * 1024
+		}
+		passed, elapsed := sendUntil(t, objs.QosCgroup, ipv4Packet(dst), &skbContext{CB: [5]uint32{cbIngress}}, 3*burst)
+		checkRate(t, bps, burst, passed, elapsed)
+	}
+}
+
+func TestDatapathPodBurst(t *testing.T) {
+	objs := loadDatapath(t)
+	w := &Writer{obj: objs}
+	dst := netip.MustParseAddr("192.168.0.10")
+
+	bps := uint64(10 * 1000 * 1000)
+	burst := uint64(128 * 1024)
+	err := w.WritePodInfo(&types.PodConfig{
+		IPs:        []types.PodIP{{Addr: dst}},
+		CgroupInfo: &types.CgroupInfo{Inode: 1},
+		RxBps:      &bps,
+		RxBurst:    burst,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passed, elapsed := sendUntil(t, objs.QosCgroup, ipv4Packet(dst), &skbContext{CB: [5]uint32{cbIngress}}, 10*burst)
+	checkRate(t, bps, burst, passed, elapsed)
+}
+
+func TestDatapathNetworkBurst(t *testing.T) {
+	objs := loadDatapath(t)
+	w := &Writer{obj: objs}
+	dst := netip.MustParseAddr("192.168.0.10")
+
+	podBps := uint64(100 * 1000 * 1000)
+	bps := uint64(10 * 1000 * 1000)
+	burst := uint64(128 * 1024)
+	err := w.WritePodInfo(&types.PodConfig{
+		IPs:          []types.PodIP{{Addr: dst, Network: 1}},
+		CgroupInfo:   &types.CgroupInfo{Inode: 1},
+		RxBps:        &podBps,
+		RxBurst:      burst,
+		NetworkRates: []types.NetworkRate{{Network: 1, RxBps: bps}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passed, elapsed := sendUntil(t, objs.QosCgroup, ipv4Packet(dst), &skbContext{CB: [5]uint32{cbIngress}}, 10*burst)
+	checkRate(t, bps, burst, passed, elapsed)
+}
+
+func TestDatapathCIDRBurst(t *testing.T) {
+	objs := loadDatapath(t)
+	w := &Writer{obj: objs}
+	dst := netip.MustParseAddr("192.168.0.10")
+
+	bps := uint64(10 * 1000 * 1000)
+	burst := uint64(128 * 1024)
+	err := w.WritePodInfo(&types.PodConfig{
+		IPs:        []types.PodIP{{Addr: dst}},
+		CgroupInfo: &types.CgroupInfo{Inode: 1},
+		RxBurst:    burst,
+		CIDRRates:  []types.CIDRRate{{CIDR: netip.MustParsePrefix("10.0.0.0/8"), RxBps: &bps}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passed, elapsed := sendUntil(t, objs.QosCgroup, ipv4Packet(dst), &skbContext{CB: [5]uint32{cbIngress}}, 10*burst)
+	checkRate(t, bps, burst, passed, elapsed)
+}
+
+func TestDatapathCIDRRateRemoved(t *testing.T) {
+	objs := loadDatapath(t)
+	w := &Writer{obj: objs}
+	dst := netip.MustParseAddr("192.168.0.10")
+
+	bps := uint64(256 * 1000)
+	pod := &types.PodConfig{
+		IPs:        []types.PodIP{{Addr: dst}},
+		CgroupInfo: &types.CgroupInfo{Inode: 1},
+		CIDRRates:  []types.CIDRRate{{CIDR: netip.MustParsePrefix("10.0.0.0/8"), RxBps: &bps}},
+	}
+	if err := w.WritePodInfo(pod); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &skbContext{CB: [5]uint32{cbIngress}}
+	passed, elapsed := sendUntil(t, objs.QosCgroup, ipv4Packet(dst), ctx, 3*bps)
+	checkRate(t, bps, bps, passed, elapsed)
+
+	// the rules are deleted once the pod has none
+	pod.CIDRRates = nil
+	if err := w.WritePodInfo(pod); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.ListCIDRRate()); n != 0 {
+		t.Fatalf("%d cidr rules left", n)
+	}
+	passed, _ = sendUntil(t, objs.QosCgroup, ipv4Packet(dst), ctx, 3*bps)
+	if passed < 3*bps {
+		t.Errorf("passed %d bytes of %d without limit", passed, 3*bps)
+	}
+}
+
+func TestDatapathClassRate(t *testing.T) {
+	objs := loadDatapath(t)
+
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		t.Fatal(err)
+	}
+	bps := uint64(256 * 1000)
+	// a class beyond the default three, the rate of classes is not adjusted within the interval
+	prio := uint32(4)
+	cfg := &globalRateCfg{
+		Interval:     uint64(time.Hour),
+		HwGuaranteed: 100 * 1000 * 1000,
+		ClassNum:     prio + 1,
+	}
+	cfg.Classes[prio].MaxBps = bps
+	err := objs.TerwayGlobalCfg.Put(&globalKey{Direction: ingressIndex}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &globalRateInfo{LastTimestamp: uint64(ts.Nano())}
+	info.Classes[prio].Bps = bps
+	err = objs.GlobalRateMap.Put(&globalKey{Direction: ingressIndex}, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &skbContext{Priority: prio, CB: [5]uint32{cbIngress}}
+	passed, elapsed := sendUntil(t, objs.QosGlobal, ipv4Packet(netip.MustParseAddr("192.168.0.10")), ctx, 3*bps)
+	checkRate(t, bps, bps, passed, elapsed)
+}
+
+// TestDatapathDSCPWithoutGlobal mark egress packets by the class without a global config
+func TestDatapathDSCPWithoutGlobal(t *testing.T) {
+	objs := loadDatapath(t)
+
+	// packets of BPF_PROG_TEST_RUN are on the loopback
+	ifindex := uint32(1)
+	prio := uint32(1)
+	cfg := &dscpCfg{}
+	for i := range cfg.DSCP {
+		cfg.DSCP[i] = dscpUnset
+	}
+	cfg.DSCP[prio] = 46
+	if err := objs.DscpMap.Put(ifindex, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := ipv4Packet(netip.MustParseAddr("192.168.0.10"))
+	// ect(0) is kept
+	pkt[15] = 0x2
+	out := make([]byte, len(pkt))
+	ret, err := objs.QosGlobal.Run(&ebpf.RunOptions{
+		Data:    pkt,
+		DataOut: out,
+		Context: &skbContext{Priority: prio, Ifindex: ifindex},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret == tcActShot {
+		t.Fatal("packet is dropped")
+	}
+	if out[15] != 46<<2|0x2 {
+		t.Errorf("tos = %#x, want %#x", out[15], 46<<2|0x2)
+	}
+}
+
+// TestDatapathEWMAStale estimate by ewma while another cpu has estimated bytes not flushed by this one
+func TestDatapathEWMAStale(t *testing.T) {
+	objs := loadDatapath(t)
+
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		t.Fatal(err)
+	}
+	key := globalKey{Direction: ingressIndex}
+	cfg := &globalRateCfg{
+		Interval:  uint64(time.Hour),
+		Estimator: estimatorEWMA,
+		SlotWidth: uint64(10 * time.Millisecond),
+		HalfLife:  uint64(100 * time.Millisecond),
+	}
+	if err := objs.TerwayGlobalCfg.Put(&key, cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &skbContext{CB: [5]uint32{cbIngress}}
+	pkt := ipv4Packet(netip.MustParseAddr("192.168.0.10"))
+	// the bytes of each cpu are counted, and flushed on the next packet
+	sendUntil(t, objs.QosCgroup, pkt, ctx, packetSize)
+	var pcpu []netStatPcpu
+	if err := objs.NetStatPcpuMap.Lookup(&key, &pcpu); err != nil {
+		t.Fatal(err)
+	}
+	for i := range pcpu {
+		pcpu[i].TFlush = 0
+	}
+	if err := objs.NetStatPcpuMap.Put(&key, pcpu); err != nil {
+		t.Fatal(err)
+	}
+	rate := uint64(1000 * 1000)
+	stat := &netStat{Bytes: 1000, TS: uint64(ts.Nano()) - uint64(time.Second), TSBytes: 1 << 40, Rate: rate}
+	if err := objs.TerwayNetStat.Put(&key, stat); err != nil {
+		t.Fatal(err)
+	}
+
+	sendUntil(t, objs.QosCgroup, pkt, ctx, packetSize)
+	if err := objs.TerwayNetStat.Lookup(&key, stat); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Bytes == 1000 {
+		t.Fatal("bytes are not flushed")
+	}
+	if stat.Rate != rate {
+		t.Errorf("rate = %d, want %d unchanged", stat.Rate, rate)
+	}
+}
+
+// BenchmarkDatapathThroughput offer packets from all cpus at the packet rate of a link, each op is a tick of 1ms.
+// bytes-err% is the bytes lost by counting, rate-err% is the error of the rate estimated, which needs a run longer
+// than the window, e.g. `make bench-datapath`.
+func BenchmarkDatapathThroughput(b *testing.B) {
+	for _, gbit := range []uint64{10, 25, 100} {
+		b.Run(fmt.Sprintf("%dGbit", gbit), func(b *testing.B) {
+			objs := loadDatapath(b)
+			w := &Writer{obj: objs}
+			pkt := ipv4Packet(netip.MustParseAddr("192.168.0.10"))
+
+			cpus := runtime.NumCPU()
+			pps := gbit * 1000 * 1000 * 1000 / 8 / packetSize
+			batch := max(pps/1000/uint64(cpus), 1)
+
+			var sent atomic.Uint64
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			start := time.Now()
+			for cpu := 0; cpu < cpus; cpu++ {
+				wg.Add(1)
+				go func(cpu int) {
+					defer wg.Done()
+					// the bytes of each cpu are counted apart until flushed
+					runtime.LockOSThread()
+					defer runtime.UnlockOSThread()
+					var set unix.CPUSet
+					set.Set(cpu)
+					if err := unix.SchedSetaffinity(0, &set); err != nil {
+						b.Error(err)
+						return
+					}
+
+					ctx := &skbContext{CB: [5]uint32{cbIngress}}
+					for i := 0; i < b.N; i++ {
+						_, err := objs.QosCgroup.Run(&ebpf.RunOptions{Data: pkt, Context: ctx, Repeat: uint32(batch)})
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						sent.Add(batch * packetSize)
+						time.Sleep(time.Until(start.Add(time.Duration(i+1) * time.Millisecond)))
+					}
+				}(cpu)
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+			b.StopTimer()
+
+			// packets without a config of the interface are counted by the default
+			key := globalKey{Direction: ingressIndex}
+			stat := w.GetNetStat()[key]
+			counted := stat.Bytes + w.GetPendingBytes()[key]
+			offered := sent.Load() * uint64(time.Second) / uint64(elapsed)
+
+			b.ReportMetric(float64(offered)*8/1e9, "Gbit")
+			b.ReportMetric(errPercent(counted, sent.Load()), "bytes-err%")
+			if stat.Rate != 0 {
+				b.ReportMetric(errPercent(stat.Rate, offered), "rate-err%")
+			}
+		})
+	}
+}
+
+func errPercent(got, want uint64) float64 {
+	if want == 0 {
+		return 0
+	}
+	return (float64(got) - float64(want)) / float64(want) * 100
+}
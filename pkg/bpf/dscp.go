@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+// dscpUnset keep the dscp of packets of the class, MUST equal with DSCP_UNSET
+const dscpUnset = 0xff
+
+// classUnset keep the class of packets with the dscp, MUST equal with CLASS_UNSET
+const classUnset = 0xff
+
+// ParseDSCP parse a dscp in decimal, or by name like EF, AF41, CS1
+func ParseDSCP(s string) (uint8, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	switch {
+	case name == "EF":
+		return 46, nil
+	case len(name) == 3 && strings.HasPrefix(name, "CS") && name[2] >= '0' && name[2] <= '7':
+		return (name[2] - '0') << 3, nil
+	case len(name) == 4 && strings.HasPrefix(name, "AF") && name[2] >= '1' && name[2] <= '4' && name[3] >= '1' && name[3] <= '3':
+		return (name[2]-'0')<<3 | (name[3]-'0')<<1, nil
+	}
+	v, err := strconv.ParseUint(name, 10, 8)
+	if err != nil || v > 63 {
+		return 0, fmt.Errorf("invalid dscp %q, expect 0 to 63 or a name like EF, AF41, CS1", s)
+	}
+	return uint8(v), nil
+}
+
+// ParseDSCPClasses parse the class to dscp table, e.g. {"L0": "AF41", "2": "CS1"}
+func ParseDSCPClasses(classes map[string]string) (map[uint32]uint8, error) {
+	result := make(map[uint32]uint8, len(classes))
+	for k, v := range classes {
+		prio, err := types.ParseClass(k)
+		if err != nil {
+			return nil, err
+		}
+		dscp, err := ParseDSCP(v)
+		if err != nil {
+			return nil, err
+		}
+		result[prio] = dscp
+	}
+	return result, nil
+}
+
+// ParseDSCPTrustClasses parse the dscp to class table, e.g. {"AF41": "L0", "8": "2"}
+func ParseDSCPTrustClasses(classes map[string]string) (map[uint8]uint32, error) {
+	result := make(map[uint8]uint32, len(classes))
+	for k, v := range classes {
+		dscp, err := ParseDSCP(k)
+		if err != nil {
+			return nil, err
+		}
+		prio, err := types.ParseClass(v)
+		if err != nil {
+			return nil, err
+		}
+		result[dscp] = prio
+	}
+	return result, nil
+}
+
+// SetDSCPMarking rewrite the dscp of egress packets on the interfaces by the class, MUST be called before Start.
+// Classes absent keep the dscp of the packets.
+func (m *Mgr) SetDSCPMarking(interfaces []string, classes map[uint32]uint8) {
+	m.dscpInterfaces = make(map[string]bool, len(interfaces))
+	for _, name := range interfaces {
+		m.dscpInterfaces[name] = true
+	}
+	m.dscpClasses = classes
+}
+
+// syncDSCP enable dscp marking on the link if configured, or disable it
+func (m *Mgr) syncDSCP(link netlink.Link) error {
+	ifindex := uint32(link.Attrs().Index)
+	if !m.enableEgress || len(m.dscpClasses) == 0 || !m.dscpInterfaces[link.Attrs().Name] || !m.validate(link) {
+		return m.deleteDSCP(ifindex)
+	}
+
+	cfg := &dscpCfg{}
+	for i := range cfg.DSCP {
+		cfg.DSCP[i] = dscpUnset
+	}
+	for prio, dscp := range m.dscpClasses {
+		cfg.DSCP[prio] = dscp
+	}
+	err := m.obj.DscpMap.Put(ifindex, cfg)
+	if err != nil {
+		return fmt.Errorf("error put dscp_map map, %w", err)
+	}
+	log.Info("set dscp marking", "dev", link.Attrs().Name, "classes", m.dscpClasses)
+	return nil
+}
+
+func (m *Mgr) deleteDSCP(ifindex uint32) error {
+	err := m.obj.DscpMap.Delete(ifindex)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("error delete dscp_map map by key %d, %w", ifindex, err)
+	}
+	return nil
+}
+
+// SetDSCPTrust replace the trusted sources, no cidrs or classes to disable it
+func (w *Writer) SetDSCPTrust(cidrs []netip.Prefix, classes map[uint8]uint32) error {
+	trust := dscpTrust{}
+	for i := range trust.Classes {
+		trust.Classes[i] = classUnset
+	}
+	for dscp, prio := range classes {
+		trust.Classes[dscp] = uint8(prio)
+	}
+
+	desired := make(map[netip.Prefix]bool, len(cidrs))
+	if len(classes) > 0 {
+		for _, cidr := range cidrs {
+			desired[cidr.Masked()] = true
+		}
+	}
+	for cidr := range w.ListDSCPTrust() {
+		if desired[cidr] {
+			continue
+		}
+		key := &dscpTrustKey{PrefixLen: prefixBits(cidr), Addr: *ip2Addr(cidr.Addr())}
+		if err := w.obj.DscpTrustMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("error delete dscp_trust_map map by key %s, %w", cidr, err)
+		}
+		log.Info("delete dscp trust", "cidr", cidr.String())
+	}
+	for cidr := range desired {
+		key := &dscpTrustKey{PrefixLen: prefixBits(cidr), Addr: *ip2Addr(cidr.Addr())}
+		if err := w.obj.DscpTrustMap.Put(key, &trust); err != nil {
+			return fmt.Errorf("error put dscp_trust_map map, %w", err)
+		}
+		log.Info("set dscp trust", "cidr", cidr.String(), "classes", classes)
+	}
+	return nil
+}
+
+func (w *Writer) ListDSCPTrust() map[netip.Prefix]dscpTrust {
+	result := make(map[netip.Prefix]dscpTrust)
+	var key dscpTrustKey
+	var value dscpTrust
+
+	iter := w.obj.DscpTrustMap.Iterate()
+	for iter.Next(&key, &value) {
+		result[key.CIDR()] = value
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseDSCP(t *testing.T) {
+	for s, want := range map[string]uint8{"EF": 46, "af41": 34, "AF11": 10, "CS1": 8, "cs0": 0, "63": 63} {
+		got, err := ParseDSCP(s)
+		if err != nil || got != want {
+			t.Errorf("ParseDSCP(%s) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"64", "AF44", "CS8", "X"} {
+		if _, err := ParseDSCP(s); err == nil {
+			t.Errorf("ParseDSCP(%s) expect error", s)
+		}
+	}
+}
+
+func TestParseDSCPClasses(t *testing.T) {
+	got, err := ParseDSCPClasses(map[string]string{"L0": "AF41", "2": "CS1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[uint32]uint8{0: 34, 2: 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseDSCPClasses() = %v, want %v", got, want)
+	}
+	if _, err = ParseDSCPClasses(map[string]string{"L8": "EF"}); err == nil {
+		t.Error("ParseDSCPClasses() expect error for invalid class")
+	}
+}
+
+func TestParseDSCPTrustClasses(t *testing.T) {
+	got, err := ParseDSCPTrustClasses(map[string]string{"AF41": "L0", "8": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[uint8]uint32{34: 0, 8: 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseDSCPTrustClasses() = %v, want %v", got, want)
+	}
+	if _, err = ParseDSCPTrustClasses(map[string]string{"EF": "L9"}); err == nil {
+		t.Error("ParseDSCPTrustClasses() expect error for invalid class")
+	}
+
+	for _, s := range []string{"10.0.0.0/8", "fd00::/8", "0.0.0.0/0"} {
+		cidr := netip.MustParsePrefix(s)
+		key := &dscpTrustKey{PrefixLen: prefixBits(cidr), Addr: *ip2Addr(cidr.Addr())}
+		if key.CIDR() != cidr {
+			t.Errorf("CIDR() = %s, want %s", key.CIDR(), cidr)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const sysClassNet = "/sys/class/net"
+
+// linkSpeed read the link speed from sysfs in bytes/s, return 0 if unknown
+func linkSpeed(root, name string) uint64 {
+	content, err := os.ReadFile(filepath.Join(root, name, "speed"))
+	if err != nil {
+		return 0
+	}
+	// in Mbit/s, -1 for unknown
+	mbps, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil || mbps <= 0 {
+		return 0
+	}
+	return uint64(mbps) * 1000 * 1000 / 8
+}
+
+// setLinkSpeed record speed of the link, 0 to remove it
+func (m *Mgr) setLinkSpeed(name string, speed uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if speed == 0 {
+		delete(m.speeds, name)
+		return
+	}
+	if m.speeds[name] != speed {
+		log.Info("link speed discovered", "dev", name, "bps", speed)
+	}
+	m.speeds[name] = speed
+}
+
+// LinkBps return the total capacity of managed links in bytes/s, 0 if unknown
+func (m *Mgr) LinkBps() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var total uint64
+	for _, speed := range m.speeds {
+		total += speed
+	}
+	return total
+}
+
+// LinkSpeed return the capacity of the managed link in bytes/s, 0 if unknown
+func (m *Mgr) LinkSpeed(name string) uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.speeds[name]
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_linkSpeed(t *testing.T) {
+	root := t.TempDir()
+	for name, speed := range map[string]string{
+		"eth0": "10000\n",
+		"eth1": "-1\n",
+		"eth2": "x",
+	} {
+		err := os.MkdirAll(filepath.Join(root, name), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, name, "speed"), []byte(speed), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want uint64
+	}{
+		{name: "eth0", want: 1250000000},
+		{name: "eth1", want: 0},
+		{name: "eth2", want: 0},
+		{name: "eth3", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := linkSpeed(root, tt.name); got != tt.want {
+				t.Errorf("linkSpeed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
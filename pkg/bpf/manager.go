@@ -20,6 +20,7 @@ import (
 	"errors"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/cilium/ebpf"
@@ -41,6 +42,14 @@ const (
 var objs *qos_tcObjects
 var once sync.Once
 
+// ecnSupported is whether the loaded datapath can mark packets
+var ecnSupported bool
+
+// ECNSupported return whether CongestionActionMark takes effect, it requires bpf_skb_ecn_set_ce and the runtime compiled datapath
+func ECNSupported() bool {
+	return ecnSupported
+}
+
 func getBpfObj(enableCORE bool) *qos_tcObjects {
 	once.Do(func() {
 		err := rlimit.RemoveMemlock()
@@ -65,6 +74,17 @@ func getBpfObj(enableCORE bool) *qos_tcObjects {
 			featEDT = true
 		}
 
+		featCgroupID := false
+		err = features.HaveProgramHelper(ebpf.SchedCLS, asm.FnSkbCgroupId)
+		if err != nil {
+			if !errors.Is(err, ebpf.ErrNotSupported) {
+				log.Error(err, "check kernel version failed")
+				os.Exit(1)
+			}
+		} else {
+			featCgroupID = true
+		}
+
 		objs = &qos_tcObjects{}
 
 		opts := &ebpf.CollectionOptions{
@@ -76,35 +96,63 @@ func getBpfObj(enableCORE bool) *qos_tcObjects {
 			MapReplacements: nil,
 		}
 
+		// FEAT_EDT is defined only when compiled on the node
+		ecnSupported = featEDT && !enableCORE
+
+		var spec *ebpf.CollectionSpec
 		if enableCORE {
-			err := loadQos_tcObjects(objs, opts)
+			spec, err = loadQos_tc()
 			if err != nil {
 				log.Error(err, "load bpf objects failed")
 				os.Exit(1)
 			}
 		} else {
-			err := Compile(featEDT)
+			err = Compile(featEDT, featCgroupID)
 			if err != nil {
 				log.Error(err, "compile bpf failed")
 				os.Exit(1)
 			}
 
-			spec, err := ebpf.LoadCollectionSpec(progPath)
-			if err != nil {
-				log.Error(err, "load bpf objects failed")
-				os.Exit(1)
-			}
-			err = spec.LoadAndAssign(objs, opts)
+			spec, err = ebpf.LoadCollectionSpec(progPath)
 			if err != nil {
 				log.Error(err, "load bpf objects failed")
 				os.Exit(1)
 			}
 		}
 
+		unpinIncompatibleMaps(spec, pinPath)
+		err = spec.LoadAndAssign(objs, opts)
+		if err != nil {
+			log.Error(err, "load bpf objects failed")
+			os.Exit(1)
+		}
+
 	})
 	return objs
 }
 
+// unpinIncompatibleMaps remove pinned maps, whose layout is changed by an upgrade.
+// The maps are recreated on load, and refilled by the syncer.
+func unpinIncompatibleMaps(spec *ebpf.CollectionSpec, root string) {
+	for name, ms := range spec.Maps {
+		if ms.Pinning != ebpf.PinByName {
+			continue
+		}
+		m, err := ebpf.LoadPinnedMap(filepath.Join(root, name), nil)
+		if err != nil {
+			continue
+		}
+		err = ms.Compatible(m)
+		if err != nil {
+			log.Info("unpin incompatible map", "map", name, "reason", err.Error())
+			if err = m.Unpin(); err != nil {
+				log.Error(err, "unpin map failed", "map", name)
+			}
+		}
+		_ = m.Close()
+	}
+}
+
 type validateDeviceFunc = func(link netlink.Link) bool
 
 type Mgr struct {
@@ -117,6 +165,14 @@ type Mgr struct {
 	prio int
 
 	validate validateDeviceFunc
+
+	// dscpInterfaces mark egress packets by dscpClasses
+	dscpInterfaces map[string]bool
+	dscpClasses    map[uint32]uint8
+
+	// speeds of the managed links, in bytes/s
+	speeds map[string]uint64
+	lock   sync.Mutex
 }
 
 func NewBpfMgr(enableIngress, enableEgress, enableCORE bool, validate validateDeviceFunc, prio int) (*Mgr, error) {
@@ -127,6 +183,7 @@ func NewBpfMgr(enableIngress, enableEgress, enableCORE bool, validate validateDe
 		enableIngress: enableIngress,
 		validate:      validate,
 		prio:          prio,
+		speeds:        map[string]uint64{},
 	}, nil
 }
 
@@ -150,6 +207,13 @@ func (m *Mgr) Start(ctx context.Context) error {
 
 	go func() {
 		for e := range m.nlEvent {
+			if e.Header.Type == unix.RTM_DELLINK {
+				m.setLinkSpeed(e.Link.Attrs().Name, 0)
+				if err := m.deleteDSCP(uint32(e.Link.Attrs().Index)); err != nil {
+					log.Error(err, "delete dscp marking failed")
+				}
+				continue
+			}
 			err = m.ensureBpfProg(e.Link)
 			if err != nil {
 				log.Error(err, "attach bpf prog failed")
@@ -167,9 +231,14 @@ func (m *Mgr) Close() {
 }
 
 func (m *Mgr) ensureBpfProg(link netlink.Link) error {
+	if err := m.syncDSCP(link); err != nil {
+		return err
+	}
 	if !m.validate(link) {
+		m.setLinkSpeed(link.Attrs().Name, 0)
 		return nil
 	}
+	m.setLinkSpeed(link.Attrs().Name, linkSpeed(sysClassNet, link.Attrs().Name))
 
 	err := ensureQdisc([]netlink.Link{link})
 	if err != nil {
@@ -21,9 +21,9 @@ import (
 	"fmt"
 	"net/netip"
 	"reflect"
-	"time"
 
-	"k8s.io/klog/v2"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 
 	"github.com/AliyunContainerService/terway-qos/pkg/byteorder"
 	"github.com/AliyunContainerService/terway-qos/pkg/types"
@@ -37,6 +37,21 @@ const (
 	egressIndex  uint32 = 1
 )
 
+// DirectionName return the name of the direction index of the maps
+func DirectionName(direction uint32) string {
+	if direction == ingressIndex {
+		return "ingress"
+	}
+	return "egress"
+}
+
+const (
+	// CongestionActionDrop drop packets over the limit
+	CongestionActionDrop = "drop"
+	// CongestionActionMark mark ECT packets over the limit with CE, and drop the others
+	CongestionActionMark = "mark"
+)
+
 var _ Interface = &Writer{}
 
 type Writer struct {
@@ -56,44 +71,49 @@ func NewMap() (*Writer, error) {
 }
 
 func (w *Writer) GetGlobalConfig() (*types.GlobalConfig, *types.GlobalConfig, error) {
+	return w.getGlobalConfig(0)
+}
+
+func (w *Writer) getGlobalConfig(ifindex uint32) (*types.GlobalConfig, *types.GlobalConfig, error) {
 	ingress := &globalRateCfg{}
 	egress := &globalRateCfg{}
-	err := w.obj.TerwayGlobalCfg.Lookup(ingressIndex, ingress)
+	err := w.obj.TerwayGlobalCfg.Lookup(&globalKey{Ifindex: ifindex, Direction: ingressIndex}, ingress)
 	if err != nil {
 		if !errors.Is(err, ebpf.ErrKeyNotExist) {
 			return nil, nil, err
 		}
 	}
-	err = w.obj.TerwayGlobalCfg.Lookup(egressIndex, egress)
+	err = w.obj.TerwayGlobalCfg.Lookup(&globalKey{Ifindex: ifindex, Direction: egressIndex}, egress)
 	if err != nil {
 		if !errors.Is(err, ebpf.ErrKeyNotExist) {
 			return nil, nil, err
 		}
 	}
 
-	return &types.GlobalConfig{
-			HwGuaranteed:   ingress.HwGuaranteed,
-			HwBurstableBps: ingress.HwBurstable,
-			L0MaxBps:       0,
-			L0MinBps:       ingress.L0MinBps,
-			L1MaxBps:       ingress.L1MaxBps,
-			L1MinBps:       ingress.L1MinBps,
-			L2MaxBps:       ingress.L2MaxBps,
-			L2MinBps:       ingress.L2MinBps,
-		}, &types.GlobalConfig{
-			HwGuaranteed:   egress.HwGuaranteed,
-			HwBurstableBps: egress.HwBurstable,
-			L0MaxBps:       0,
-			L0MinBps:       egress.L0MinBps,
-			L1MaxBps:       egress.L1MaxBps,
-			L1MinBps:       egress.L1MinBps,
-			L2MaxBps:       egress.L2MaxBps,
-			L2MinBps:       egress.L2MinBps,
-		}, nil
-}
-
-func updateIfNotEqual(expect any, idx uint32, lookupo func(idx uint32) (any, error), update func(idx uint32, rateCfg any) error) error {
-	prev, err := lookupo(idx)
+	return ingress.globalConfig(), egress.globalConfig(), nil
+}
+
+func (w *Writer) ListGlobalConfig() (map[uint32]*types.InterfaceConfig, error) {
+	result := map[uint32]*types.InterfaceConfig{}
+	var key globalKey
+	var value globalRateCfg
+
+	iter := w.obj.TerwayGlobalCfg.Iterate()
+	for iter.Next(&key, &value) {
+		if _, ok := result[key.Ifindex]; ok {
+			continue
+		}
+		ingress, egress, err := w.getGlobalConfig(key.Ifindex)
+		if err != nil {
+			return nil, err
+		}
+		result[key.Ifindex] = &types.InterfaceConfig{Ingress: ingress, Egress: egress}
+	}
+	return result, iter.Err()
+}
+
+func updateIfNotEqual(expect any, key globalKey, lookupo func(key globalKey) (any, error), update func(key globalKey, rateCfg any) error) error {
+	prev, err := lookupo(key)
 	if err != nil {
 		if !errors.Is(err, ebpf.ErrKeyNotExist) {
 			return err
@@ -103,84 +123,108 @@ func updateIfNotEqual(expect any, idx uint32, lookupo func(idx uint32) (any, err
 		return nil
 	}
 
-	return update(idx, expect)
+	return update(key, expect)
 }
 
 func (w *Writer) WriteGlobalConfig(ingress *types.GlobalConfig, egress *types.GlobalConfig) error {
+	return w.writeGlobalConfig(0, ingress, egress)
+}
+
+func (w *Writer) writeGlobalConfig(ifindex uint32, ingress *types.GlobalConfig, egress *types.GlobalConfig) error {
 	ingress.Default()
-	if !ingress.Validate() {
-		return fmt.Errorf("ingress config is not valid, %#v", *ingress)
-	}
 	egress.Default()
-	if !egress.Validate() {
-		return fmt.Errorf("egress config is not valid, %#v", *egress)
-	}
-
-	ingressCfg := &globalRateCfg{
-		Interval:     uint64(500 * time.Millisecond),
-		HwGuaranteed: ingress.HwGuaranteed,
-		HwBurstable:  0,
-		L0MinBps:     ingress.HwGuaranteed - ingress.L1MinBps - ingress.L2MinBps,
-		L1MinBps:     ingress.L1MinBps,
-		L1MaxBps:     ingress.L1MaxBps,
-		L2MinBps:     ingress.L2MinBps,
-		L2MaxBps:     ingress.L2MaxBps,
-	}
-	egressCfg := &globalRateCfg{
-		Interval:     uint64(500 * time.Millisecond),
-		HwGuaranteed: egress.HwGuaranteed,
-		HwBurstable:  0,
-		L0MinBps:     egress.HwGuaranteed - egress.L1MinBps - egress.L2MinBps,
-		L1MinBps:     egress.L1MinBps,
-		L1MaxBps:     egress.L1MaxBps,
-		L2MinBps:     egress.L2MinBps,
-		L2MaxBps:     egress.L2MaxBps,
-	}
-
-	lookRateFunc := func(idx uint32) (any, error) {
+	errs := ingress.Validate(field.NewPath("ingress"))
+	errs = append(errs, egress.Validate(field.NewPath("egress"))...)
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid global config, %w", errs.ToAggregate())
+	}
+
+	ingressCfg := newGlobalRateCfg(ingress)
+	egressCfg := newGlobalRateCfg(egress)
+
+	lookRateFunc := func(key globalKey) (any, error) {
 		prev := &globalRateCfg{}
-		err := w.obj.TerwayGlobalCfg.Lookup(idx, prev)
+		err := w.obj.TerwayGlobalCfg.Lookup(&key, prev)
 		return prev, err
 	}
 
-	updateRateFunc := func(idx uint32, rateCfg any) error {
-		idxtostr := map[uint32]string{
-			ingressIndex: "ingress",
-			egressIndex:  "egress",
+	updateRateFunc := func(key globalKey, rateCfg any) error {
+		cfg := ingress
+		if key.Direction == egressIndex {
+			cfg = egress
 		}
-		log.Info("write global config", idxtostr[idx], egress.String())
-		return w.obj.TerwayGlobalCfg.Put(idx, rateCfg)
+		log.Info("write global config", "ifindex", key.Ifindex, "direction", DirectionName(key.Direction), "config", cfg.String())
+		return w.obj.TerwayGlobalCfg.Put(&key, rateCfg)
 	}
 
-	if err := updateIfNotEqual(ingressCfg, ingressIndex, lookRateFunc, updateRateFunc); err != nil {
+	if err := updateIfNotEqual(ingressCfg, globalKey{Ifindex: ifindex, Direction: ingressIndex}, lookRateFunc, updateRateFunc); err != nil {
 		return err
 	}
-	return updateIfNotEqual(egressCfg, egressIndex, lookRateFunc, updateRateFunc)
+	return updateIfNotEqual(egressCfg, globalKey{Ifindex: ifindex, Direction: egressIndex}, lookRateFunc, updateRateFunc)
 }
 
-func (w *Writer) WritePodInfo(config *types.PodConfig) error {
-	if config.HostNetwork {
-		return nil
+func (w *Writer) WriteInterfaceConfig(configs map[uint32]*types.InterfaceConfig) error {
+	for ifindex, cfg := range configs {
+		if ifindex == 0 {
+			return fmt.Errorf("invalid ifindex 0 for interface config")
+		}
+		err := w.writeGlobalConfig(ifindex, cfg.Ingress, cfg.Egress)
+		if err != nil {
+			return fmt.Errorf("error write config of ifindex %d, %w", ifindex, err)
+		}
 	}
-	info := &cgroupInfo{
-		ClassID: config.CgroupInfo.ClassID,
-		Pad1:    uint32(0),
-		Inode:   config.CgroupInfo.Inode,
+
+	// interfaces no longer configured fall back to the global limit, their rate and throughput are dropped as well
+	var stale []globalKey
+	var key globalKey
+	var value globalRateCfg
+	iter := w.obj.TerwayGlobalCfg.Iterate()
+	for iter.Next(&key, &value) {
+		if _, ok := configs[key.Ifindex]; ok || key.Ifindex == 0 {
+			continue
+		}
+		stale = append(stale, key)
 	}
-	if config.IPv4.IsValid() {
-		err := w.obj.PodMap.Put(ip2Addr(config.IPv4), info)
-		if err != nil {
-			return fmt.Errorf("error put pod_map map, %w", err)
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range stale {
+		log.Info("delete interface config", "ifindex", key.Ifindex, "direction", DirectionName(key.Direction))
+		for _, m := range []*ebpf.Map{w.obj.TerwayGlobalCfg, w.obj.GlobalRateMap, w.obj.TerwayNetStat, w.obj.NetStatPcpuMap} {
+			if err := m.Delete(&key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				return fmt.Errorf("error delete %s by ifindex %d, %w", m.String(), key.Ifindex, err)
+			}
 		}
 	}
-	if config.IPv6.IsValid() {
-		err := w.obj.PodMap.Put(ip2Addr(config.IPv6), info)
+	return nil
+}
+
+func (w *Writer) WritePodInfo(config *types.PodConfig) error {
+	if config.HostNetwork && (config.CgroupInfo == nil || !config.CgroupInfo.V2) {
+		return nil
+	}
+	if config.HostNetwork {
+		// host network pods share the node ip, index by cgroup id instead
+		err := w.obj.CgroupInfoMap.Put(config.CgroupInfo.Inode, &cgroupInfo{
+			ClassID: config.CgroupInfo.ClassID,
+			Inode:   config.CgroupInfo.Inode,
+		})
 		if err != nil {
-			return fmt.Errorf("error put pod_map map, %w", err)
+			return fmt.Errorf("error put cgroup_info_map map, %w", err)
+		}
+	} else {
+		for _, ip := range config.IPs {
+			err := w.obj.PodMap.Put(ip2Addr(ip.Addr), &cgroupInfo{
+				ClassID: config.CgroupInfo.ClassID,
+				Network: ip.Network,
+				Inode:   config.CgroupInfo.Inode,
+			})
+			if err != nil {
+				return fmt.Errorf("error put pod_map map, %w", err)
+			}
 		}
 	}
 
-	klog.Infof("write pod info, %v", config)
 	rx := uint64(0)
 	tx := uint64(0)
 	if config.RxBps != nil {
@@ -189,29 +233,177 @@ func (w *Writer) WritePodInfo(config *types.PodConfig) error {
 	if config.TxBps != nil {
 		tx = *config.TxBps
 	}
+	log.Info("write pod info", "pod", config.PodID, "uid", config.PodUID, "inode", config.CgroupInfo.Inode,
+		"hostNetwork", config.HostNetwork, "ips", config.IPs, "classID", config.CgroupInfo.ClassID, "rxBps", rx, "txBps", tx)
 
-	return w.WriteCgroupRate(&types.CgroupRate{
-		Inode: config.CgroupInfo.Inode,
-		RxBps: rx,
-		TxBps: tx,
+	err := w.WriteCgroupRate(&types.CgroupRate{
+		Inode:   config.CgroupInfo.Inode,
+		RxBps:   rx,
+		TxBps:   tx,
+		RxBurst: config.RxBurst,
+		TxBurst: config.TxBurst,
 	})
+	if err != nil {
+		return err
+	}
+	for _, rate := range config.NetworkRates {
+		err = w.WriteCgroupRate(&types.CgroupRate{
+			Inode:   config.CgroupInfo.Inode,
+			Network: rate.Network,
+			RxBps:   rate.RxBps,
+			TxBps:   rate.TxBps,
+			// the burst of the pod applies to each network
+			RxBurst: config.RxBurst,
+			TxBurst: config.TxBurst,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err = w.writePortClass(config.CgroupInfo.Inode, config.PortClasses); err != nil {
+		return err
+	}
+	return w.writeCIDRRates(config.CgroupInfo.Inode, config.CIDRRates, config.RxBurst, config.TxBurst)
 }
 
-func (w *Writer) DeletePodInfo(config *types.PodConfig) error {
-	if config.HostNetwork {
+// writePortClass replace port rules of the pod, no rules to delete them
+func (w *Writer) writePortClass(inode uint64, classes []types.PortClass) error {
+	if len(classes) == 0 {
+		return w.DeletePortClass(inode)
+	}
+	rules := newPortClassRules(classes)
+	prev := &portClassRules{}
+	if err := w.obj.PortClassMap.Lookup(inode, prev); err == nil && *prev == *rules {
 		return nil
 	}
+	log.Info("update port class", "inode", inode, "rules", classes)
+	if err := w.obj.PortClassMap.Put(inode, rules); err != nil {
+		return fmt.Errorf("error put port_class_map map, %w", err)
+	}
+	return nil
+}
+
+func (w *Writer) ListPortClass() map[uint64]portClassRules {
+	result := make(map[uint64]portClassRules)
+	var key uint64
+	var value portClassRules
+
+	iter := w.obj.PortClassMap.Iterate()
+	for iter.Next(&key, &value) {
+		result[key] = value
+	}
+	return result
+}
+
+func (w *Writer) DeletePortClass(inode uint64) error {
+	if err := w.obj.PortClassMap.Delete(inode); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("error delete port_class_map map by key %d, %w", inode, err)
+	}
+	return nil
+}
 
-	ips := []netip.Addr{config.IPv4, config.IPv6}
-	for _, ip := range ips {
-		if !ip.IsValid() {
+// writeCIDRRates replace cidr rates of the pod, rules not in rates are deleted.
+// The burst of the pod applies to each rule.
+func (w *Writer) writeCIDRRates(inode uint64, rates []types.CIDRRate, rxBurst, txBurst uint64) error {
+	desired := make(map[cidrRateKey]rateInfo)
+	for _, rate := range rates {
+		if rate.RxBps != nil {
+			desired[*newCIDRRateKey(inode, ingressIndex, rate.CIDR)] = rateInfo{LimitBps: *rate.RxBps, Burst: rxBurst}
+		}
+		if rate.TxBps != nil {
+			desired[*newCIDRRateKey(inode, egressIndex, rate.CIDR)] = rateInfo{LimitBps: *rate.TxBps, Burst: txBurst}
+		}
+	}
+
+	for key, prev := range w.ListCIDRRate() {
+		if key.Inode != inode {
+			continue
+		}
+		if cur, ok := desired[key]; ok {
+			// keep the bucket state of unchanged rules
+			if cur.LimitBps == prev.LimitBps && cur.Burst == prev.Burst {
+				delete(desired, key)
+			}
 			continue
 		}
-		if err := w.obj.PodMap.Delete(ip2Addr(ip)); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
-			return fmt.Errorf("error put pod_map map by key %s, %w", ip, err)
+		key := key
+		if err := w.obj.CidrRateMap.Delete(&key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("error delete cidr_rate_map map by key %s, %w", key.CIDR(), err)
 		}
+		log.Info("delete cidr rate", "inode", inode, "cidr", key.CIDR().String(), "direction", key.Direction)
 	}
 
+	for key, cur := range desired {
+		key, cur := key, cur
+		log.Info("update cidr rate", "inode", inode, "cidr", key.CIDR().String(), "direction", key.Direction, "bps", cur.LimitBps, "burst", cur.Burst)
+		if err := w.obj.CidrRateMap.Put(&key, &cur); err != nil {
+			return fmt.Errorf("error put cidr_rate_map map, %w", err)
+		}
+	}
+	return nil
+}
+
+func (w *Writer) DeletePodInfo(config *types.PodConfig) error {
+	if config.HostNetwork {
+		if config.CgroupInfo == nil || !config.CgroupInfo.V2 {
+			return nil
+		}
+		if err := w.DeleteCgroupInfo(config.CgroupInfo.Inode); err != nil {
+			return err
+		}
+		return w.deleteCgroup(config.CgroupInfo)
+	}
+
+	for _, ip := range config.IPs {
+		if err := w.DeletePodIP(ip.Addr); err != nil {
+			return err
+		}
+	}
+
+	return w.deleteCgroup(config.CgroupInfo)
+}
+
+// deleteCgroup delete the rate and counters of the pod
+func (w *Writer) deleteCgroup(info *types.CgroupInfo) error {
+	if info == nil {
+		return nil
+	}
+	if err := w.DeleteCgroupRate(info.Inode); err != nil {
+		return fmt.Errorf("error delete cgroup_rate_map map by key %d, %w", info.Inode, err)
+	}
+	if err := w.DeleteCIDRRate(info.Inode); err != nil {
+		return err
+	}
+	if err := w.DeletePortClass(info.Inode); err != nil {
+		return err
+	}
+	return w.DeleteCgroupStat(info.Inode)
+}
+
+func (w *Writer) DeletePodIP(ip netip.Addr) error {
+	if err := w.obj.PodMap.Delete(ip2Addr(ip)); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("error delete pod_map map by key %s, %w", ip, err)
+	}
+	return nil
+}
+
+func (w *Writer) DeleteCgroupInfo(inode uint64) error {
+	if err := w.obj.CgroupInfoMap.Delete(inode); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("error delete cgroup_info_map map by key %d, %w", inode, err)
+	}
+	return nil
+}
+
+func (w *Writer) DeleteCgroupStat(inode uint64) error {
+	for _, cur := range []uint32{egressIndex, ingressIndex} {
+		key := &cgroupRateID{
+			Inode:     inode,
+			Direction: cur,
+		}
+		if err := w.obj.CgroupStatMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("error delete cgroup_stat_map map by key %d, %w", inode, err)
+		}
+	}
 	return nil
 }
 
@@ -227,12 +419,28 @@ func (w *Writer) ListPodInfo() map[netip.Addr]cgroupInfo {
 	return result
 }
 
+func (w *Writer) ListCgroupInfo() map[uint64]cgroupInfo {
+	var result = map[uint64]cgroupInfo{}
+	var key uint64
+	var value cgroupInfo
+
+	iter := w.obj.CgroupInfoMap.Iterate()
+	for iter.Next(&key, &value) {
+		result[key] = value
+	}
+	return result
+}
+
 func (w *Writer) GetGlobalRateLimit() (*globalRateInfo, *globalRateInfo) {
+	return w.GetInterfaceRateLimit(0)
+}
+
+func (w *Writer) GetInterfaceRateLimit(ifindex uint32) (*globalRateInfo, *globalRateInfo) {
 	var ingress = &globalRateInfo{}
 	var egress = &globalRateInfo{}
-	_ = w.obj.GlobalRateMap.Lookup(ingressIndex, ingress)
+	_ = w.obj.GlobalRateMap.Lookup(&globalKey{Ifindex: ifindex, Direction: ingressIndex}, ingress)
 
-	_ = w.obj.GlobalRateMap.Lookup(egressIndex, egress)
+	_ = w.obj.GlobalRateMap.Lookup(&globalKey{Ifindex: ifindex, Direction: egressIndex}, egress)
 	return ingress, egress
 }
 
@@ -248,14 +456,14 @@ func (w *Writer) ListCgroupRate() map[cgroupRateID]rateInfo {
 	return result
 }
 
+// DeleteCgroupRate delete rates of the pod, include those of secondary networks
 func (w *Writer) DeleteCgroupRate(inode uint64) error {
-	direction := []uint32{egressIndex, ingressIndex}
-	for _, cur := range direction {
-		obj := &cgroupRateID{
-			Inode:     inode,
-			Direction: cur,
+	for id := range w.ListCgroupRate() {
+		if id.Inode != inode {
+			continue
 		}
-		if err := w.obj.CgroupRateMap.Delete(obj); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		id := id
+		if err := w.obj.CgroupRateMap.Delete(&id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
 			return err
 		}
 	}
@@ -263,70 +471,66 @@ func (w *Writer) DeleteCgroupRate(inode uint64) error {
 	return nil
 }
 
-func (w *Writer) WriteCgroupRate(r *types.CgroupRate) error {
-	egressID := &cgroupRateID{
-		Inode:     r.Inode,
-		Direction: egressIndex,
-	}
-	ingressID := &cgroupRateID{
-		Inode:     r.Inode,
-		Direction: ingressIndex,
+func (w *Writer) ListCIDRRate() map[cidrRateKey]rateInfo {
+	result := make(map[cidrRateKey]rateInfo)
+	var key cidrRateKey
+	var value rateInfo
+
+	iter := w.obj.CidrRateMap.Iterate()
+	for iter.Next(&key, &value) {
+		result[key] = value
 	}
-	if r.RxBps == 0 {
-		err := w.obj.CgroupRateMap.Delete(ingressID)
-		if err != nil {
-			if !errors.Is(err, ebpf.ErrKeyNotExist) {
-				return err
-			}
-		} else {
-			log.Info("delete rate", "ingress", r.RxBps)
-		}
-	} else {
-		prev := &rateInfo{}
-		err := w.obj.CgroupRateMap.Lookup(ingressID, prev)
-		if err != nil {
-			if !errors.Is(err, ebpf.ErrKeyNotExist) {
-				return err
-			}
-		}
-		if prev.LimitBps == r.RxBps {
-			return nil
-		}
-		log.Info("update rate", "rxBps", r.RxBps)
+	return result
+}
 
-		err = w.obj.CgroupRateMap.Put(ingressID, &rateInfo{
-			LimitBps:      r.RxBps,
-			LastTimeStamp: 0,
-		})
-		if err != nil {
-			return err
+// DeleteCIDRRate delete cidr rates of the pod
+func (w *Writer) DeleteCIDRRate(inode uint64) error {
+	return w.writeCIDRRates(inode, nil, 0, 0)
+}
+
+// WriteCgroupRate update rate of the pod or a secondary network, 0 to delete the rate
+func (w *Writer) WriteCgroupRate(r *types.CgroupRate) error {
+	for _, cur := range []struct {
+		direction uint32
+		bps       uint64
+		burst     uint64
+	}{
+		{direction: ingressIndex, bps: r.RxBps, burst: r.RxBurst},
+		{direction: egressIndex, bps: r.TxBps, burst: r.TxBurst},
+	} {
+		id := &cgroupRateID{
+			Inode:     r.Inode,
+			Direction: cur.direction,
+			Network:   r.Network,
 		}
-	}
-	if r.TxBps == 0 {
-		err := w.obj.CgroupRateMap.Delete(egressID)
-		if err != nil {
-			if !errors.Is(err, ebpf.ErrKeyNotExist) {
-				return err
+		if cur.bps == 0 {
+			err := w.obj.CgroupRateMap.Delete(id)
+			if err != nil {
+				if !errors.Is(err, ebpf.ErrKeyNotExist) {
+					return err
+				}
+			} else {
+				log.Info("delete rate", "inode", r.Inode, "network", r.Network, "direction", cur.direction)
 			}
-		} else {
-			log.Info("delete rate", "txBps", r.TxBps)
+			continue
 		}
-	} else {
+
 		prev := &rateInfo{}
-		err := w.obj.CgroupRateMap.Lookup(egressID, prev)
+		err := w.obj.CgroupRateMap.Lookup(id, prev)
 		if err != nil {
 			if !errors.Is(err, ebpf.ErrKeyNotExist) {
 				return err
 			}
 		}
-		if prev.LimitBps == r.TxBps {
-			return nil
+		if prev.LimitBps == cur.bps && prev.Burst == cur.burst {
+			continue
 		}
-		log.Info("update rate", "txBps", r.TxBps)
+		log.Info("update rate", "inode", r.Inode, "network", r.Network, "direction", cur.direction, "bps", cur.bps, "burst", cur.burst)
 
-		err = w.obj.CgroupRateMap.Put(egressID, &rateInfo{
-			LimitBps:      r.TxBps,
+		err = w.obj.CgroupRateMap.Put(id, &rateInfo{
+			LimitBps:      cur.bps,
 			LastTimeStamp: 0,
+			Burst:         cur.burst,
 		})
 		if err != nil {
 			return err
@@ -335,17 +539,105 @@ func (w *Writer) WriteCgroupRate(r *types.CgroupRate) error {
 	return nil
 }
 
-func (w *Writer) GetNetStat() []netStat {
-	var result []netStat
-	ite := w.obj.TerwayNetStat.Iterate()
-	var key uint32
+func (w *Writer) ListCgroupStat() map[cgroupRateID]qosStat {
+	result := make(map[cgroupRateID]qosStat)
+	var key cgroupRateID
+	var values []qosStat
+
+	iter := w.obj.CgroupStatMap.Iterate()
+	for iter.Next(&key, &values) {
+		result[key] = sumStat(values)
+	}
+	return result
+}
+
+func (w *Writer) ListClassStat() map[classStatID]qosStat {
+	result := make(map[classStatID]qosStat)
+	var key classStatID
+	var values []qosStat
+
+	iter := w.obj.ClassStatMap.Iterate()
+	for iter.Next(&key, &values) {
+		result[key] = sumStat(values)
+	}
+	return result
+}
+
+func sumStat(values []qosStat) qosStat {
+	total := qosStat{}
+	for i := range values {
+		total.add(&values[i])
+	}
+	return total
+}
+
+func (w *Writer) GetNetStat() map[globalKey]netStat {
+	result := make(map[globalKey]netStat)
+	var key globalKey
 	var stat netStat
+
+	ite := w.obj.TerwayNetStat.Iterate()
 	for ite.Next(&key, &stat) {
-		result = append(result, stat)
+		result[key] = stat
 	}
 	return result
 }
 
+// GetPendingBytes return bytes counted by all cpus, but not flushed to the net stat yet
+func (w *Writer) GetPendingBytes() map[globalKey]uint64 {
+	result := make(map[globalKey]uint64)
+	var key globalKey
+	var values []netStatPcpu
+
+	ite := w.obj.NetStatPcpuMap.Iterate()
+	for ite.Next(&key, &values) {
+		for _, v := range values {
+			result[key] += v.Pending
+		}
+	}
+	return result
+}
+
+func (w *Writer) GetThroughput() (uint64, uint64) {
+	return w.throughput(func(key globalKey) bool { return true })
+}
+
+func (w *Writer) GetInterfaceThroughput(ifindex uint32) (uint64, uint64) {
+	return w.throughput(func(key globalKey) bool { return key.Ifindex == ifindex })
+}
+
+// throughput sum the rate sampled of interfaces matched
+func (w *Writer) throughput(match func(key globalKey) bool) (uint64, uint64) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, 0
+	}
+	now := uint64(ts.Nano())
+
+	var ingress, egress uint64
+	for key, stat := range w.GetNetStat() {
+		if !match(key) {
+			continue
+		}
+		switch key.Direction {
+		case ingressIndex:
+			ingress += sampledRate(&stat, now)
+		case egressIndex:
+			egress += sampledRate(&stat, now)
+		}
+	}
+	return ingress, egress
+}
+
+// sampledRate return the rate estimated, 0 if it is estimated over two of the widest slots ago.
+// A slot is estimated by the first flush after it ends, so the rate is stale once the traffic stops.
+func sampledRate(stat *netStat, now uint64) uint64 {
+	if stat.TS == 0 || now < stat.TS || now-stat.TS >= 2*uint64(types.MaxSlotWidth) {
+		return 0
+	}
+	return stat.Rate
+}
+
 func ip2Addr(ip netip.Addr) *addr {
 	slice := ip.As16()
 	return &addr{
@@ -365,3 +657,20 @@ func addr2ip(addr *addr) netip.Addr {
 	ip, _ := netip.AddrFromSlice(slice)
 	return ip
 }
+
+func (w *Writer) SetCongestionAction(action string) error {
+	opts := &qosOpts{}
+	err := w.obj.QosOptsMap.Lookup(uint32(0), opts)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case CongestionActionDrop:
+		opts.Flags &^= optECNMark
+	case CongestionActionMark:
+		opts.Flags |= optECNMark
+	default:
+		return fmt.Errorf("invalid congestion action %q, expect %s or %s", action, CongestionActionDrop, CongestionActionMark)
+	}
+	return w.obj.QosOptsMap.Put(uint32(0), opts)
+}
@@ -19,6 +19,7 @@ import (
 	"net/netip"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_ip2Addr(t *testing.T) {
@@ -61,6 +62,70 @@ func Test_ip2Addr(t *testing.T) {
 	}
 }
 
+func Test_sumStat(t *testing.T) {
+	values := []qosStat{
+		{PassBytes: 100, PassPackets: 1},
+		{PassBytes: 200, PassPackets: 2, DropBytes: 1500, DropPackets: 1},
+		{DelayBytes: 300, DelayPackets: 3},
+	}
+	want := qosStat{
+		PassBytes:    300,
+		PassPackets:  3,
+		DropBytes:    1500,
+		DropPackets:  1,
+		DelayBytes:   300,
+		DelayPackets: 3,
+	}
+	if got := sumStat(values); !reflect.DeepEqual(got, want) {
+		t.Errorf("sumStat() = %v, want %v", got, want)
+	}
+}
+
 func Test_NewMap(t *testing.T) {
 
 }
+
+func Test_sampledRate(t *testing.T) {
+	now := uint64(10 * time.Second)
+	tests := []struct {
+		name string
+		stat netStat
+		want uint64
+	}{
+		{"recent", netStat{TS: now - uint64(500*time.Millisecond), Rate: 200}, 200},
+		{"stale", netStat{TS: now - uint64(2*time.Second), Rate: 200}, 0},
+		{"ahead", netStat{TS: now + 1, Rate: 200}, 0},
+		{"empty", netStat{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sampledRate(&tt.stat, now); got != tt.want {
+				t.Errorf("sampledRate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newCIDRRateKey(t *testing.T) {
+	tests := []struct {
+		cidr      string
+		prefixLen uint32
+		wantAddr  *addr
+	}{
+		{cidr: "0.0.0.0/0", prefixLen: 96 + 96, wantAddr: &addr{D3: 0xffff0000}},
+		{cidr: "10.0.0.0/8", prefixLen: 96 + 96 + 8, wantAddr: &addr{D3: 0xffff0000, D4: 0x0000000a}},
+		{cidr: "fd00::/8", prefixLen: 96 + 8, wantAddr: &addr{D1: 0x000000fd}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			cidr := netip.MustParsePrefix(tt.cidr)
+			key := newCIDRRateKey(1, egressIndex, cidr)
+			if key.PrefixLen != tt.prefixLen || !reflect.DeepEqual(&key.Addr, tt.wantAddr) {
+				t.Errorf("newCIDRRateKey() = %+v", key)
+			}
+			if key.CIDR() != cidr {
+				t.Errorf("CIDR() = %s, want %s", key.CIDR(), cidr)
+			}
+		})
+	}
+}
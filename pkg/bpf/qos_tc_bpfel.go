@@ -63,9 +63,19 @@ type qos_tcProgramSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type qos_tcMapSpecs struct {
+	CgroupInfoMap   *ebpf.MapSpec `ebpf:"cgroup_info_map"`
 	CgroupRateMap   *ebpf.MapSpec `ebpf:"cgroup_rate_map"`
+	CgroupStatMap   *ebpf.MapSpec `ebpf:"cgroup_stat_map"`
+	CidrRateMap     *ebpf.MapSpec `ebpf:"cidr_rate_map"`
+	ClassStatMap    *ebpf.MapSpec `ebpf:"class_stat_map"`
+	DscpMap         *ebpf.MapSpec `ebpf:"dscp_map"`
+	DscpTrustMap    *ebpf.MapSpec `ebpf:"dscp_trust_map"`
 	GlobalRateMap   *ebpf.MapSpec `ebpf:"global_rate_map"`
+	NetStatPcpuMap  *ebpf.MapSpec `ebpf:"net_stat_pcpu_map"`
+	NetStatZero     *ebpf.MapSpec `ebpf:"net_stat_zero"`
 	PodMap          *ebpf.MapSpec `ebpf:"pod_map"`
+	PortClassMap    *ebpf.MapSpec `ebpf:"port_class_map"`
+	QosOptsMap      *ebpf.MapSpec `ebpf:"qos_opts_map"`
 	QosProgMap      *ebpf.MapSpec `ebpf:"qos_prog_map"`
 	TerwayGlobalCfg *ebpf.MapSpec `ebpf:"terway_global_cfg"`
 	TerwayNetStat   *ebpf.MapSpec `ebpf:"terway_net_stat"`
@@ -90,9 +100,19 @@ func (o *qos_tcObjects) Close() error {
 //
 // It can be passed to loadQos_tcObjects or ebpf.CollectionSpec.LoadAndAssign.
 type qos_tcMaps struct {
+	CgroupInfoMap   *ebpf.Map `ebpf:"cgroup_info_map"`
 	CgroupRateMap   *ebpf.Map `ebpf:"cgroup_rate_map"`
+	CgroupStatMap   *ebpf.Map `ebpf:"cgroup_stat_map"`
+	CidrRateMap     *ebpf.Map `ebpf:"cidr_rate_map"`
+	ClassStatMap    *ebpf.Map `ebpf:"class_stat_map"`
+	DscpMap         *ebpf.Map `ebpf:"dscp_map"`
+	DscpTrustMap    *ebpf.Map `ebpf:"dscp_trust_map"`
 	GlobalRateMap   *ebpf.Map `ebpf:"global_rate_map"`
+	NetStatPcpuMap  *ebpf.Map `ebpf:"net_stat_pcpu_map"`
+	NetStatZero     *ebpf.Map `ebpf:"net_stat_zero"`
 	PodMap          *ebpf.Map `ebpf:"pod_map"`
+	PortClassMap    *ebpf.Map `ebpf:"port_class_map"`
+	QosOptsMap      *ebpf.Map `ebpf:"qos_opts_map"`
 	QosProgMap      *ebpf.Map `ebpf:"qos_prog_map"`
 	TerwayGlobalCfg *ebpf.Map `ebpf:"terway_global_cfg"`
 	TerwayNetStat   *ebpf.Map `ebpf:"terway_net_stat"`
@@ -100,9 +120,19 @@ type qos_tcMaps struct {
 
 func (m *qos_tcMaps) Close() error {
 	return _Qos_tcClose(
+		m.CgroupInfoMap,
 		m.CgroupRateMap,
+		m.CgroupStatMap,
+		m.CidrRateMap,
+		m.ClassStatMap,
+		m.DscpMap,
+		m.DscpTrustMap,
 		m.GlobalRateMap,
+		m.NetStatPcpuMap,
+		m.NetStatZero,
 		m.PodMap,
+		m.PortClassMap,
+		m.QosOptsMap,
 		m.QosProgMap,
 		m.TerwayGlobalCfg,
 		m.TerwayNetStat,
@@ -17,23 +17,60 @@ package bpf
 
 import (
 	"net/netip"
+	"time"
 
 	"github.com/AliyunContainerService/terway-qos/pkg/types"
 )
 
 type Interface interface {
-	// WriteGlobalConfig write global limit
+	// WriteGlobalConfig write global limit, shared by interfaces without their own config
 	WriteGlobalConfig(ingress *types.GlobalConfig, egress *types.GlobalConfig) error
+	GetGlobalConfig() (*types.GlobalConfig, *types.GlobalConfig, error)
+	// WriteInterfaceConfig replace the config of interfaces by ifindex, the others fall back to the global limit
+	WriteInterfaceConfig(configs map[uint32]*types.InterfaceConfig) error
+	// ListGlobalConfig return the config of each interface by ifindex, 0 for the global limit
+	ListGlobalConfig() (map[uint32]*types.InterfaceConfig, error)
 	// WritePodInfo write class_id or rate limit for each pod
 	WritePodInfo(config *types.PodConfig) error
 	DeletePodInfo(config *types.PodConfig) error
 
 	ListPodInfo() map[netip.Addr]cgroupInfo
+	DeletePodIP(ip netip.Addr) error
+	ListCgroupInfo() map[uint64]cgroupInfo
+	DeleteCgroupInfo(inode uint64) error
 	GetGlobalRateLimit() (*globalRateInfo, *globalRateInfo)
+	// GetInterfaceRateLimit return the rate of the interface with its own config, ifindex 0 for the global limit
+	GetInterfaceRateLimit(ifindex uint32) (*globalRateInfo, *globalRateInfo)
+	GetNetStat() map[globalKey]netStat
+	// GetPendingBytes return bytes counted by all cpus, but not flushed to the net stat yet
+	GetPendingBytes() map[globalKey]uint64
+	// GetThroughput return ingress and egress bps of all interfaces sampled by the datapath in the last second
+	GetThroughput() (uint64, uint64)
+	// GetInterfaceThroughput return bps of the interface with its own config, ifindex 0 for the others
+	GetInterfaceThroughput(ifindex uint32) (uint64, uint64)
 
 	ListCgroupRate() map[cgroupRateID]rateInfo
 	WriteCgroupRate(config *types.CgroupRate) error
 	DeleteCgroupRate(inode uint64) error
+
+	ListCIDRRate() map[cidrRateKey]rateInfo
+	DeleteCIDRRate(inode uint64) error
+
+	ListPortClass() map[uint64]portClassRules
+	DeletePortClass(inode uint64) error
+
+	// ListCgroupStat return counters for each pod, summed over all cpus
+	ListCgroupStat() map[cgroupRateID]qosStat
+	DeleteCgroupStat(inode uint64) error
+	// ListClassStat return counters for each priority class, summed over all cpus
+	ListClassStat() map[classStatID]qosStat
+
+	// SetDSCPTrust classify ingress packets from the cidrs by the dscp, others keep the class of the pod
+	SetDSCPTrust(cidrs []netip.Prefix, classes map[uint8]uint32) error
+	ListDSCPTrust() map[netip.Prefix]dscpTrust
+
+	// SetCongestionAction set what to do with packets over the limit, CongestionActionDrop or CongestionActionMark
+	SetCongestionAction(action string) error
 }
 
 // rate for current rate and limit
@@ -41,6 +78,8 @@ type rateInfo struct {
 	LimitBps      uint64 `ebpf:"bps"`
 	LastTimeStamp uint64 `ebpf:"t_last"`
 	Slot          uint64 `ebpf:"slot3"`
+	// Burst is the bucket size in bytes, 0 for one second of traffic
+	Burst uint64 `ebpf:"burst"`
 }
 
 // addr for both ipv4 and ipv6
@@ -56,46 +95,261 @@ type addr struct {
 type cgroupRateID struct {
 	Inode     uint64 `ebpf:"inode"`
 	Direction uint32 `ebpf:"direction"`
-	Pad       uint32 `ebpf:"pad"`
+	Network   uint32 `ebpf:"network"`
+}
+
+// cidrKeyPrefix is the bits of direction and inode, which are always matched
+const cidrKeyPrefix = 32 + 64
+
+// cidrRateKey is the lpm key of cidr_rate_map, ipv4 is mapped to ipv6
+type cidrRateKey struct {
+	PrefixLen uint32 `ebpf:"prefixlen"`
+	Direction uint32 `ebpf:"direction"`
+	Inode     uint64 `ebpf:"inode"`
+	Addr      addr   `ebpf:"addr"`
+}
+
+func newCIDRRateKey(inode uint64, direction uint32, cidr netip.Prefix) *cidrRateKey {
+	return &cidrRateKey{
+		PrefixLen: cidrKeyPrefix + prefixBits(cidr),
+		Direction: direction,
+		Inode:     inode,
+		Addr:      *ip2Addr(cidr.Addr()),
+	}
+}
+
+// CIDR return the peer cidr of the key
+func (k *cidrRateKey) CIDR() netip.Prefix {
+	return addrPrefix(&k.Addr, int(k.PrefixLen)-cidrKeyPrefix)
+}
+
+// prefixBits return the prefix length of the cidr mapped to ipv6
+func prefixBits(cidr netip.Prefix) uint32 {
+	if cidr.Addr().Is4() {
+		return uint32(96 + cidr.Bits())
+	}
+	return uint32(cidr.Bits())
+}
+
+// addrPrefix is the reverse of prefixBits
+func addrPrefix(a *addr, bits int) netip.Prefix {
+	ip := addr2ip(a)
+	if ip.Is4In6() && bits >= 96 {
+		return netip.PrefixFrom(ip.Unmap(), bits-96)
+	}
+	return netip.PrefixFrom(ip, bits)
+}
+
+// dscpTrustKey is the lpm key of dscp_trust_map, ipv4 is mapped to ipv6
+type dscpTrustKey struct {
+	PrefixLen uint32 `ebpf:"prefixlen"`
+	Addr      addr   `ebpf:"addr"`
+}
+
+// CIDR return the trusted source of the key
+func (k *dscpTrustKey) CIDR() netip.Prefix {
+	return addrPrefix(&k.Addr, int(k.PrefixLen))
+}
+
+// dscpTrust is the class of each dscp, classUnset to keep the class of the pod
+type dscpTrust struct {
+	Classes [64]uint8 `ebpf:"classes"`
+}
+
+// portRulePeer match the port of the peer instead of the pod
+const portRulePeer = 1 << 0
+
+type portClassRule struct {
+	Protocol uint8  `ebpf:"protocol"`
+	Flags    uint8  `ebpf:"flags"`
+	ClassID  uint16 `ebpf:"class_id"`
+	PortMin  uint16 `ebpf:"port_min"`
+	PortMax  uint16 `ebpf:"port_max"`
+}
+
+// portClassRules are the port rules of a pod, the first match wins
+type portClassRules struct {
+	Num   uint32                              `ebpf:"num"`
+	Pad   uint32                              `ebpf:"pad"`
+	Rules [types.MaxPortClasses]portClassRule `ebpf:"rules"`
+}
+
+func newPortClassRules(classes []types.PortClass) *portClassRules {
+	rules := &portClassRules{}
+	for i, c := range classes {
+		if i >= types.MaxPortClasses {
+			break
+		}
+		rule := portClassRule{Protocol: c.Protocol, ClassID: uint16(c.Class), PortMin: c.PortMin, PortMax: c.PortMax}
+		if c.Peer {
+			rule.Flags |= portRulePeer
+		}
+		rules.Rules[i] = rule
+		rules.Num++
+	}
+	return rules
+}
+
+// dscpCfg is the dscp of each class on an interface
+type dscpCfg struct {
+	DSCP [types.MaxClasses]uint8 `ebpf:"dscp"`
 }
 
 type cgroupInfo struct {
 	ClassID uint32 `ebpf:"class_id"`
-	Pad1    uint32 `ebpf:"pad1"`
+	Network uint32 `ebpf:"network"`
 	Inode   uint64 `ebpf:"inode"`
 }
 
+// globalKey index the global config, rate and throughput of an interface, ifindex 0 is the global limit
+type globalKey struct {
+	Ifindex   uint32 `ebpf:"ifindex"`
+	Direction uint32 `ebpf:"direction"`
+}
+
+type classCfg struct {
+	MinBps uint64 `ebpf:"min_bps"`
+	MaxBps uint64 `ebpf:"max_bps"`
+}
+
+// estimatorWindow and estimatorEWMA MUST equal with ESTIMATOR_WINDOW and ESTIMATOR_EWMA
+const (
+	estimatorWindow uint32 = iota
+	estimatorEWMA
+)
+
 type globalRateCfg struct {
 	Interval     uint64 `ebpf:"interval"`
 	HwGuaranteed uint64 `ebpf:"hw_min_bps"`
 	HwBurstable  uint64 `ebpf:"hw_max_bps"`
+	MaxCredit    uint64 `ebpf:"max_credit"`
 
-	L0MinBps uint64 `ebpf:"l0_min_bps"`
-	L0MaxBps uint64 `ebpf:"l0_max_bps"`
-	L1MinBps uint64 `ebpf:"l1_min_bps"`
-	L1MaxBps uint64 `ebpf:"l1_max_bps"`
-	L2MinBps uint64 `ebpf:"l2_min_bps"`
-	L2MaxBps uint64 `ebpf:"l2_max_bps"`
+	Estimator uint32 `ebpf:"estimator"`
+	SlotNum   uint32 `ebpf:"slot_num"`
+	SlotWidth uint64 `ebpf:"slot_width"`
+	HalfLife  uint64 `ebpf:"half_life"`
+
+	ClassNum uint32                     `ebpf:"class_num"`
+	Pad      uint32                     `ebpf:"pad"`
+	Classes  [types.MaxClasses]classCfg `ebpf:"classes"`
+}
+
+// newGlobalRateCfg convert the validated config for the datapath, the defaults MUST be filled
+func newGlobalRateCfg(c *types.GlobalConfig) *globalRateCfg {
+	cfg := &globalRateCfg{
+		Interval:     uint64(c.Interval),
+		HwGuaranteed: c.HwGuaranteed,
+		HwBurstable:  c.HwBurstableBps,
+		MaxCredit:    c.BurstCredit,
+		SlotNum:      c.Estimator.SlotNum,
+		SlotWidth:    uint64(c.Estimator.SlotWidth),
+		HalfLife:     uint64(c.Estimator.HalfLife),
+		ClassNum:     uint32(len(c.Classes)),
+	}
+	if c.Estimator.Type == types.EstimatorEWMA {
+		cfg.Estimator = estimatorEWMA
+	}
+	for i, class := range c.Classes {
+		cfg.Classes[i] = classCfg{MinBps: class.MinBps, MaxBps: class.MaxBps}
+	}
+	return cfg
+}
+
+func (c *globalRateCfg) globalConfig() *types.GlobalConfig {
+	cfg := &types.GlobalConfig{
+		Interval:       time.Duration(c.Interval),
+		HwGuaranteed:   c.HwGuaranteed,
+		HwBurstableBps: c.HwBurstable,
+		BurstCredit:    c.MaxCredit,
+		Estimator: types.RateEstimator{
+			Type:      types.EstimatorWindow,
+			SlotWidth: time.Duration(c.SlotWidth),
+			SlotNum:   c.SlotNum,
+			HalfLife:  time.Duration(c.HalfLife),
+		},
+	}
+	if c.Estimator == estimatorEWMA {
+		cfg.Estimator.Type = types.EstimatorEWMA
+	}
+	for i := 0; i < int(c.ClassNum) && i < types.MaxClasses; i++ {
+		cfg.Classes = append(cfg.Classes, types.ClassConfig{MinBps: c.Classes[i].MinBps, MaxBps: c.Classes[i].MaxBps})
+	}
+	return cfg
+}
+
+// classRate current rate of a priority class
+type classRate struct {
+	LastTimestamp uint64 `ebpf:"t_last"`
+	Bps           uint64 `ebpf:"bps"`
+	Slot          uint64 `ebpf:"slot"`
 }
 
 type globalRateInfo struct {
 	LastTimestamp uint64 `ebpf:"t_last"`
+	// Credit is the bytes left to burst over the guaranteed host bandwidth
+	Credit uint64 `ebpf:"credit"`
 
-	L0LastTimestamp uint64 `ebpf:"t_l0_last"`
-	L0Bps           uint64 `ebpf:"l0_bps"`
-	L0Slot          uint64 `ebpf:"l0_slot"`
+	Classes [types.MaxClasses]classRate `ebpf:"classes"`
+}
+
+// netStatSlotMax MUST equal with EST_SLOT_MAX
+const netStatSlotMax = types.MaxSlotNum
 
-	L1LastTimestamp uint64 `ebpf:"t_l1_last"`
-	L1Bps           uint64 `ebpf:"l1_bps"`
-	L1Slot          uint64 `ebpf:"l1_slot"`
+// netStat is the bytes of an interface, flushed from netStatPcpu by all cpus
+type netStat struct {
+	Bytes   uint64 `ebpf:"bytes"`
+	TS      uint64 `ebpf:"ts"`
+	TSBytes uint64 `ebpf:"ts_bytes"`
+	// Rate is the bytes/s estimated at TS
+	Rate uint64 `ebpf:"rate"`
 
-	L2LastTimestamp uint64 `ebpf:"t_l2_last"`
-	L2Bps           uint64 `ebpf:"l2_bps"`
-	L2Slot          uint64 `ebpf:"l2_slot"`
+	Slots [netStatSlotMax]netStatSlot `ebpf:"slots"`
 }
 
-type netStat struct {
-	Index uint64 `ebpf:"index"`
+// netStatSlot is a snapshot of the window estimator
+type netStatSlot struct {
 	TS    uint64 `ebpf:"ts"`
-	Val   uint64 `ebpf:"val"`
+	Bytes uint64 `ebpf:"bytes"`
+}
+
+// netStatPcpu is the bytes counted by a cpu, not flushed yet
+type netStatPcpu struct {
+	Pending uint64 `ebpf:"pending"`
+	TFlush  uint64 `ebpf:"t_flush"`
+}
+
+// qosStat counters for the packets passed, dropped, delayed(edt) and marked(ecn)
+type qosStat struct {
+	PassBytes    uint64 `ebpf:"pass_bytes"`
+	PassPackets  uint64 `ebpf:"pass_packets"`
+	DropBytes    uint64 `ebpf:"drop_bytes"`
+	DropPackets  uint64 `ebpf:"drop_packets"`
+	DelayBytes   uint64 `ebpf:"delay_bytes"`
+	DelayPackets uint64 `ebpf:"delay_packets"`
+	MarkBytes    uint64 `ebpf:"mark_bytes"`
+	MarkPackets  uint64 `ebpf:"mark_packets"`
+}
+
+func (s *qosStat) add(o *qosStat) {
+	s.PassBytes += o.PassBytes
+	s.PassPackets += o.PassPackets
+	s.DropBytes += o.DropBytes
+	s.DropPackets += o.DropPackets
+	s.DelayBytes += o.DelayBytes
+	s.DelayPackets += o.DelayPackets
+	s.MarkBytes += o.MarkBytes
+	s.MarkPackets += o.MarkPackets
+}
+
+const optECNMark uint32 = 1 << 0
+
+// qosOpts datapath options
+type qosOpts struct {
+	Flags uint32 `ebpf:"flags"`
+	Pad   uint32 `ebpf:"pad"`
+}
+
+type classStatID struct {
+	ClassID   uint32 `ebpf:"class_id"`
+	Direction uint32 `ebpf:"direction"`
 }
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/cache"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/byteorder"
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+const (
+	cgroupRootPath          = "/sys/fs/cgroup"
+	systemdV2CgroupRootPath = "/sys/fs/cgroup/kubepods.slice"
+	defaultV2CgroupRootPath = "/sys/fs/cgroup/kubepods"
+)
+
+var _ Interface = &CgroupV2{}
+
+// CgroupV2 is the backend for the unified hierarchy.
+// There is no net_cls controller, the priority is taken from pod config and pods are indexed by cgroup id.
+type CgroupV2 struct {
+	cgroupPath string
+	workPath   []string
+
+	cache *cache.LRUExpireCache
+}
+
+func NewCgroupV2() *CgroupV2 {
+	cg := CgroupV2{
+		cache:      cache.NewLRUExpireCache(maxPodPerNode),
+		cgroupPath: defaultV2CgroupRootPath,
+		workPath:   defaultwalkPath,
+	}
+	if _, err := os.Stat(systemdV2CgroupRootPath); err == nil {
+		cg.cgroupPath = systemdV2CgroupRootPath
+		cg.workPath = systemdwalkPath
+	}
+
+	return &cg
+}
+
+func (f *CgroupV2) GetCgroupByPodUID(id string) (*types.CgroupInfo, error) {
+	v, ok := f.cache.Get(id)
+	if !ok {
+		// update all cache
+		result := walkPodCgroups(f.cgroupPath, f.workPath, readCgroupV2Info)
+		for uid, info := range result {
+			f.cache.Add(uid, info, defaultTTL)
+		}
+		v, ok = f.cache.Get(id)
+		if !ok {
+			return nil, fmt.Errorf("not found")
+		}
+	}
+
+	info := v.(types.CgroupInfo)
+	return &info, nil
+}
+
+// GetCgroupByPath return the pod cgroup of path, which may be the cgroup of a container in the pod
+func (f *CgroupV2) GetCgroupByPath(path string) (*types.CgroupInfo, error) {
+	info, err := readCgroupV2Info(podCgroupPath(path))
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// SetCgroupClassID is a no-op, host network pods are classified by cgroup id in bpf
+func (f *CgroupV2) SetCgroupClassID(prio uint32, path string) error {
+	return nil
+}
+
+// podCgroupPath return the closest ancestor of path named by the pod uid, path itself if there is none.
+// Pods are indexed by the id of the pod cgroup, the datapath look up the ancestors of the container cgroup.
+func podCgroupPath(path string) string {
+	for p := filepath.Clean(path); p != "/" && p != "."; p = filepath.Dir(p) {
+		if podUIDRe.MatchString(filepath.Base(p)) {
+			return p
+		}
+	}
+	return path
+}
+
+func readCgroupV2Info(path string) (types.CgroupInfo, error) {
+	id, err := cgroupID(path)
+	if err != nil {
+		return types.CgroupInfo{}, fmt.Errorf("error read cgroup id, %w", err)
+	}
+
+	return types.CgroupInfo{
+		Path:  path,
+		Inode: id,
+		V2:    true,
+	}, nil
+}
+
+// cgroupID return the kernel cgroup id, same as bpf_skb_cgroup_id()
+func cgroupID(path string) (uint64, error) {
+	handle, _, err := unix.NameToHandleAt(unix.AT_FDCWD, path, 0)
+	if err != nil {
+		return 0, fmt.Errorf("name_to_handle_at %s, %w", path, err)
+	}
+	b := handle.Bytes()
+	if len(b) < 8 {
+		return 0, fmt.Errorf("unexpected file handle size %d", len(b))
+	}
+	return byteorder.Native.Uint64(b[:8]), nil
+}
+
+func isCgroupV2(path string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false
+	}
+	return st.Type == unix.CGROUP2_SUPER_MAGIC
+}
@@ -25,10 +25,12 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
 	"github.com/AliyunContainerService/terway-qos/pkg/types"
 
 	"k8s.io/apimachinery/pkg/util/cache"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -48,9 +50,19 @@ var (
 
 type Interface interface {
 	GetCgroupByPodUID(string) (*types.CgroupInfo, error)
+	GetCgroupByPath(string) (*types.CgroupInfo, error)
 	SetCgroupClassID(prio uint32, path string) error
 }
 
+// NewCgroupInterface return the cgroup v2 backend when the unified hierarchy is mounted, or the net_cls one
+func NewCgroupInterface() Interface {
+	if isCgroupV2(cgroupRootPath) {
+		log.Info("cgroup v2 detected", "path", cgroupRootPath)
+		return NewCgroupV2()
+	}
+	return NewCgroup()
+}
+
 type Cgroup struct {
 	cgroupPath string
 	workPath   []string
@@ -81,7 +93,7 @@ func (f *Cgroup) GetCgroupByPodUID(id string) (*types.CgroupInfo, error) {
 	v, ok := f.cache.Get(id)
 	if !ok {
 		// update all cache
-		result := f.getCgroupPath()
+		result := walkPodCgroups(f.cgroupPath, f.workPath, readCgroupInfo)
 		for uid, info := range result {
 			f.cache.Add(uid, info, defaultTTL)
 		}
@@ -95,60 +107,253 @@ func (f *Cgroup) GetCgroupByPodUID(id string) (*types.CgroupInfo, error) {
 	return &info, nil
 }
 
+func (f *Cgroup) GetCgroupByPath(path string) (*types.CgroupInfo, error) {
+	info, err := readCgroupInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
 func (f *Cgroup) SetCgroupClassID(prio uint32, path string) error {
 	return os.WriteFile(filepath.Join(path, "net_cls.classid"), []byte(strconv.Itoa(int(prio))), 0644)
 }
 
-func GetGlobalConfig(path string) (*types.GlobalConfig, *types.GlobalConfig, error) {
+// GetGlobalConfig read global config from path.
+// Files end with .yaml, .yml or .json are decoded as Node, others are parsed as the legacy key-value format.
+// linkBps is the discovered link capacity, used when the host bandwidth is absent. 0 means unknown.
+func GetGlobalConfig(path string, linkBps uint64) (*types.GlobalConfig, *types.GlobalConfig, error) {
 	c, err := os.ReadFile(path)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml", ".json":
+		node, err := parseNode(c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parse %s, %w", path, err)
+		}
+		ingress, egress, err := node.GlobalConfig(linkBps)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parse %s, %w", path, err)
+		}
+		return ingress, egress, nil
+	}
+
 	ingress := &types.GlobalConfig{}
 	egress := &types.GlobalConfig{}
 
-	egress.HwGuaranteed = parseConfig("hw_tx_bps_max", string(c))
+	if v, ok := findConfig("adjust_interval_ms", string(c)); ok {
+		ms, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid adjust_interval_ms %q, %w", v, err)
+		}
+		ingress.Interval = time.Duration(ms) * time.Millisecond
+		egress.Interval = time.Duration(ms) * time.Millisecond
+	}
 
-	egress.L0MinBps = parseConfig("online_tx_bps_min", string(c))
-	egress.L0MaxBps = parseConfig("online_tx_bps_max", string(c))
+	estimator := types.RateEstimator{}
+	if v, ok := findConfig("rate_estimator", string(c)); ok {
+		estimator.Type = v
+	}
+	for _, kv := range []struct {
+		key string
+		val *time.Duration
+	}{
+		{"rate_slot_width_ms", &estimator.SlotWidth},
+		{"rate_half_life_ms", &estimator.HalfLife},
+	} {
+		if v, ok := findConfig(kv.key, string(c)); ok {
+			ms, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q, %w", kv.key, v, err)
+			}
+			*kv.val = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v, ok := findConfig("rate_slot_num", string(c)); ok {
+		num, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid rate_slot_num %q, %w", v, err)
+		}
+		estimator.SlotNum = uint32(num)
+	}
+	ingress.Estimator = estimator
+	egress.Estimator = estimator
+
+	headroom := uint64(0)
+	if v, ok := findConfig("hw_bps_headroom_percent", string(c)); ok {
+		headroom, err = strconv.ParseUint(v, 10, 64)
+		if err != nil || headroom > 100 {
+			return nil, nil, fmt.Errorf("invalid hw_bps_headroom_percent %q, expect 0 to 100", v)
+		}
+	}
+
+	for _, kv := range []struct {
+		key string
+		val *uint64
+	}{
+		{"hw_tx_bps_max", &egress.HwGuaranteed},
+		{"hw_rx_bps_max", &ingress.HwGuaranteed},
+	} {
+		*kv.val, err = parseConfig(kv.key, string(c))
+		if err != nil {
+			return nil, nil, err
+		}
+		*kv.val = hwFromLink(*kv.val, linkBps, headroom)
+	}
 
-	egress.L1MinBps = parseConfig("offline_l1_tx_bps_min", string(c))
-	egress.L1MaxBps = parseConfig("offline_l1_tx_bps_max", string(c))
-	egress.L2MinBps = parseConfig("offline_l2_tx_bps_min", string(c))
-	egress.L2MaxBps = parseConfig("offline_l2_tx_bps_max", string(c))
+	for _, kv := range []struct {
+		key string
+		val *uint64
+	}{
+		{"hw_tx_bps_burstable", &egress.HwBurstableBps},
+		{"hw_rx_bps_burstable", &ingress.HwBurstableBps},
+		{"hw_tx_burst_credit", &egress.BurstCredit},
+		{"hw_rx_burst_credit", &ingress.BurstCredit},
+	} {
+		*kv.val, err = parseConfig(kv.key, string(c))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
-	ingress.HwGuaranteed = parseConfig("hw_rx_bps_max", string(c))
+	type classKey struct {
+		key  string
+		cfg  *types.GlobalConfig
+		prio int
+		max  bool
+	}
+	keys := []classKey{
+		{"online_tx_bps_min", egress, 0, false},
+		{"online_tx_bps_max", egress, 0, true},
+		{"offline_l1_tx_bps_min", egress, 1, false},
+		{"offline_l1_tx_bps_max", egress, 1, true},
+		{"offline_l2_tx_bps_min", egress, 2, false},
+		{"offline_l2_tx_bps_max", egress, 2, true},
 
-	ingress.L0MinBps = parseConfig("online_rx_bps_min", string(c))
-	ingress.L0MaxBps = parseConfig("online_rx_bps_max", string(c))
+		{"online_rx_bps_min", ingress, 0, false},
+		{"online_rx_bps_max", ingress, 0, true},
+		{"offline_l1_rx_bps_min", ingress, 1, false},
+		{"offline_l1_rx_bps_max", ingress, 1, true},
+		{"offline_l2_rx_bps_min", ingress, 2, false},
+		{"offline_l2_rx_bps_max", ingress, 2, true},
+	}
+	// any class can be configured by its index, e.g. l3_tx_bps_min
+	for i := 0; i < types.MaxClasses; i++ {
+		keys = append(keys,
+			classKey{fmt.Sprintf("l%d_tx_bps_min", i), egress, i, false},
+			classKey{fmt.Sprintf("l%d_tx_bps_max", i), egress, i, true},
+			classKey{fmt.Sprintf("l%d_rx_bps_min", i), ingress, i, false},
+			classKey{fmt.Sprintf("l%d_rx_bps_max", i), ingress, i, true},
+		)
+	}
 
-	ingress.L1MinBps = parseConfig("offline_l1_rx_bps_min", string(c))
-	ingress.L1MaxBps = parseConfig("offline_l1_rx_bps_max", string(c))
-	ingress.L2MinBps = parseConfig("offline_l2_rx_bps_min", string(c))
-	ingress.L2MaxBps = parseConfig("offline_l2_rx_bps_max", string(c))
+	for _, kv := range keys {
+		v, ok := findConfig(kv.key, string(c))
+		if !ok {
+			continue
+		}
+		limit, err := bandwidth.ParseLimit(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s, %w", kv.key, err)
+		}
+		val, err := resolveLimit(kv.key, limit, kv.cfg.HwGuaranteed)
+		if err != nil {
+			return nil, nil, err
+		}
+		if kv.max {
+			kv.cfg.Class(kv.prio).MaxBps = val
+		} else {
+			kv.cfg.Class(kv.prio).MinBps = val
+		}
+	}
 
 	return ingress, egress, nil
 }
 
-func parseConfig(key string, content string) uint64 {
-	re, err := regexp.Compile(fmt.Sprintf("%s(?:=?|\\s+)(\\d+)", key))
+// GetInterfaceConfigs read the config of each interface from path, by the interface name.
+// Only the structured config has interface sections, nil is returned for the legacy key-value format.
+func GetInterfaceConfigs(path string, linkSpeed func(name string) uint64) (map[string]*types.InterfaceConfig, error) {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml", ".json":
+	default:
+		return nil, nil
+	}
+	c, err := os.ReadFile(path)
 	if err != nil {
-		return 0
+		return nil, err
+	}
+	node, err := parseNode(c)
+	if err != nil {
+		return nil, fmt.Errorf("error parse %s, %w", path, err)
+	}
+	configs, err := node.InterfaceConfigs(linkSpeed)
+	if err != nil {
+		return nil, fmt.Errorf("error parse %s, %w", path, err)
+	}
+	return configs, nil
+}
+
+// hwFromLink return the host bandwidth, fall back to the link capacity minus the headroom if not configured
+func hwFromLink(hw, linkBps, headroomPercent uint64) uint64 {
+	if hw != 0 || linkBps == 0 {
+		return hw
+	}
+	return linkBps / 100 * (100 - headroomPercent)
+}
+
+// resolveLimit convert the limit to bytes/s, percentage is relative to the host bandwidth
+func resolveLimit(key string, limit bandwidth.Limit, hw uint64) (uint64, error) {
+	if limit.IsPercent() && hw == 0 {
+		return 0, fmt.Errorf("%s is %s, but the host bandwidth is neither configured nor discovered", key, limit)
+	}
+	return limit.Value(hw), nil
+}
+
+// parseNode decode yaml or json, unknown fields are rejected
+func parseNode(content []byte) (*Node, error) {
+	node := &Node{}
+	err := yaml.UnmarshalStrict(content, node)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// findConfig find value of the key, in format of "key value" or "key=value"
+func findConfig(key string, content string) (string, bool) {
+	re, err := regexp.Compile(fmt.Sprintf(`(?:^|\s)%s(?:\s*=\s*|\s+)(\S+)`, regexp.QuoteMeta(key)))
+	if err != nil {
+		return "", false
 	}
 	group := re.FindStringSubmatch(content)
 	if len(group) != 2 {
-		return 0
+		return "", false
 	}
-	result, _ := strconv.ParseUint(group[1], 10, 64)
-	return result
+	return group[1], true
+}
+
+// parseConfig parse bandwidth of the key to bytes/s, return 0 if key not found
+func parseConfig(key string, content string) (uint64, error) {
+	v, ok := findConfig(key, content)
+	if !ok {
+		return 0, nil
+	}
+	result, err := bandwidth.ParseBps(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s, %w", key, err)
+	}
+	return result, nil
 }
 
-func (f *Cgroup) getCgroupPath() map[string]types.CgroupInfo {
+// walkPodCgroups find all pod level cgroup under root, index by pod uid
+func walkPodCgroups(root string, walkPath []string, read func(path string) (types.CgroupInfo, error)) map[string]types.CgroupInfo {
 	result := map[string]types.CgroupInfo{}
 
-	for _, p := range f.workPath {
-		path := filepath.Join(f.cgroupPath, p)
+	for _, p := range walkPath {
+		path := filepath.Join(root, p)
 		entries, err := os.ReadDir(path)
 		if os.IsNotExist(err) {
 			continue
@@ -162,7 +367,7 @@ func (f *Cgroup) getCgroupPath() map[string]types.CgroupInfo {
 			if uid == "" {
 				continue
 			}
-			info, err := readCgroupInfo(filepath.Join(path, entry.Name()))
+			info, err := read(filepath.Join(path, entry.Name()))
 			if err != nil {
 				log.Error(err, "error read cgroup info")
 			} else {
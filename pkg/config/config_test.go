@@ -16,7 +16,12 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
 )
 
 func Test_parseConfig(t *testing.T) {
@@ -57,9 +62,368 @@ offline_l2_rx_bps_max 30`
 	}
 	for _, tt := range tests {
 		t.Run(tt.key, func(t *testing.T) {
-			if got := parseConfig(tt.key, contents); got != tt.want {
+			got, err := parseConfig(tt.key, contents)
+			if err != nil {
+				t.Fatalf("parseConfig() error = %v", err)
+			}
+			if got != tt.want {
 				t.Errorf("parseConfig() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func Test_parseConfigUnits(t *testing.T) {
+	contents := `hw_tx_bps_max 1Gbit
+hw_rx_bps_max=125MB/s
+offline_l1_tx_bps_min 10Mi
+l1_tx_bps_min 1
+offline_l2_tx_bps_min 10x`
+
+	tests := []struct {
+		key     string
+		want    uint64
+		wantErr bool
+	}{
+		{key: "hw_tx_bps_max", want: 125000000},
+		{key: "hw_rx_bps_max", want: 125000000},
+		{key: "offline_l1_tx_bps_min", want: 10 * 1024 * 1024},
+		// must not match the suffix of offline_l1_tx_bps_min
+		{key: "l1_tx_bps_min", want: 1},
+		{key: "offline_l1_tx_bps_max", want: 0},
+		{key: "offline_l2_tx_bps_min", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, err := parseConfig(tt.key, contents)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_walkPodCgroups(t *testing.T) {
+	root := t.TempDir()
+	dirs := []string{
+		"kubepods-burstable.slice/kubepods-burstable-pod0b4e2a8c_0b3d_4b1e_9f0e_3c4f5a6b7c8d.slice",
+		"kubepods-besteffort.slice/kubepods-besteffort-pod1c5f3b9d_1c4e_4c2f_8a1f_4d5a6b7c8d9e.slice",
+		"kubepods-pod2d6a4c0e_2d5f_4d3a_9b2a_5e6b7c8d9e0f.slice",
+		"kubepods-burstable.slice/not-a-pod",
+	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := walkPodCgroups(root, systemdwalkPath, func(path string) (types.CgroupInfo, error) {
+		return types.CgroupInfo{Path: path, V2: true}, nil
+	})
+
+	want := map[string]string{
+		"0b4e2a8c-0b3d-4b1e-9f0e-3c4f5a6b7c8d": dirs[0],
+		"1c5f3b9d-1c4e-4c2f-8a1f-4d5a6b7c8d9e": dirs[1],
+		"2d6a4c0e-2d5f-4d3a-9b2a-5e6b7c8d9e0f": dirs[2],
+	}
+	if len(got) != len(want) {
+		t.Fatalf("walkPodCgroups() got %d pods, want %d", len(got), len(want))
+	}
+	for uid, dir := range want {
+		info, ok := got[uid]
+		if !ok {
+			t.Errorf("pod %s not found", uid)
+			continue
+		}
+		if info.Path != filepath.Join(root, dir) {
+			t.Errorf("pod %s path = %s, want %s", uid, info.Path, filepath.Join(root, dir))
+		}
+	}
+}
+
+func Test_podCgroupPath(t *testing.T) {
+	pod := "/sys/fs/cgroup/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0b4e2a8c_0b3d_4b1e_9f0e_3c4f5a6b7c8d.slice"
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"pod", pod, pod},
+		{"container", pod + "/cri-containerd-4f1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9.scope", pod},
+		{"cgroupfs container", "/sys/fs/cgroup/kubepods/besteffort/pod1c5f3b9d-1c4e-4c2f-8a1f-4d5a6b7c8d9e/abc", "/sys/fs/cgroup/kubepods/besteffort/pod1c5f3b9d-1c4e-4c2f-8a1f-4d5a6b7c8d9e"},
+		{"not a pod", "/sys/fs/cgroup/system.slice/kubelet.service", "/sys/fs/cgroup/system.slice/kubelet.service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podCgroupPath(tt.path); got != tt.want {
+				t.Errorf("podCgroupPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetGlobalConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "global_bps_config")
+	contents := `adjust_interval_ms 200
+hw_tx_bps_max 100
+hw_rx_bps_max 200
+offline_l1_tx_bps_min 10
+offline_l1_tx_bps_max 20
+offline_l2_rx_bps_min 30
+offline_l2_rx_bps_max 40`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ingress, egress, err := GetGlobalConfig(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ingress.Interval != 200*time.Millisecond || egress.Interval != 200*time.Millisecond {
+		t.Errorf("GetGlobalConfig() interval = %s %s, want %s", ingress.Interval, egress.Interval, 200*time.Millisecond)
+	}
+	if egress.HwGuaranteed != 100 || egress.Classes[1].MinBps != 10 || egress.Classes[1].MaxBps != 20 {
+		t.Errorf("GetGlobalConfig() egress = %s", egress)
+	}
+	if ingress.HwGuaranteed != 200 || ingress.Classes[2].MinBps != 30 || ingress.Classes[2].MaxBps != 40 {
+		t.Errorf("GetGlobalConfig() ingress = %s", ingress)
+	}
+}
+
+func TestGetGlobalConfigStructured(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"global_bps_config.yaml": `adjust_interval_ms: 500
+hw_tx_bps_max: 100
+hw_rx_bps_max: 200
+l0_tx_bps_min: 60
+l1_tx_bps_min: 10
+l1_tx_bps_max: 20
+l2_rx_bps_min: 30
+l2_rx_bps_max: 40
+`,
+		"global_bps_config.json": `{"adjust_interval_ms": 500, "hw_tx_bps_max": 100, "hw_rx_bps_max": 200, "l0_tx_bps_min": 60,
+"l1_tx_bps_min": 10, "l1_tx_bps_max": 20, "l2_rx_bps_min": 30, "l2_rx_bps_max": 40}`,
+	}
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ingress, egress, err := GetGlobalConfig(path, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ingress.Interval != 500*time.Millisecond || egress.Interval != 500*time.Millisecond {
+				t.Errorf("GetGlobalConfig() interval = %s %s", ingress.Interval, egress.Interval)
+			}
+			if egress.HwGuaranteed != 100 || egress.Classes[0].MinBps != 60 || egress.Classes[1].MinBps != 10 || egress.Classes[1].MaxBps != 20 {
+				t.Errorf("GetGlobalConfig() egress = %s", egress)
+			}
+			if ingress.HwGuaranteed != 200 || ingress.Classes[2].MinBps != 30 || ingress.Classes[2].MaxBps != 40 {
+				t.Errorf("GetGlobalConfig() ingress = %s", ingress)
+			}
+		})
+	}
+}
+
+func TestGetGlobalConfigClasses(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"global_bps_config": `hw_tx_bps_max 100
+offline_l1_tx_bps_max 20
+l3_tx_bps_max 30
+l4_tx_bps_min 5
+l4_tx_bps_max 10%`,
+		"global_bps_config.yaml": `hw_tx_bps_max: 100
+l1_tx_bps_max: 20
+classes:
+- tx_bps_max: 30
+- tx_bps_min: 5
+  tx_bps_max: 10%
+`,
+	}
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, egress, err := GetGlobalConfig(path, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(egress.Classes) != 5 || egress.Classes[1].MaxBps != 20 || egress.Classes[3].MaxBps != 30 ||
+				egress.Classes[4].MinBps != 5 || egress.Classes[4].MaxBps != 10 {
+				t.Errorf("GetGlobalConfig() egress = %s", egress)
+			}
+		})
+	}
+}
+
+func TestGetGlobalConfigUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "global_bps_config.yaml")
+	if err := os.WriteFile(path, []byte("hw_tx_bps_max: 100\nhw_tx_bps_mx: 200\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := GetGlobalConfig(path, 0)
+	if err == nil {
+		t.Fatal("GetGlobalConfig() expect error for unknown field")
+	}
+}
+
+func TestGetGlobalConfigLinkBps(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"global_bps_config": `hw_bps_headroom_percent 10
+hw_rx_bps_max 500
+offline_l1_tx_bps_min 10%
+offline_l1_tx_bps_max 20%
+offline_l2_rx_bps_min 30
+offline_l2_rx_bps_max 40%`,
+		"global_bps_config.yaml": `hw_bps_headroom_percent: 10
+hw_rx_bps_max: 500
+l1_tx_bps_min: 10%
+l1_tx_bps_max: "20%"
+l2_rx_bps_min: 30
+l2_rx_bps_max: 40%
+`,
+	}
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			ingress, egress, err := GetGlobalConfig(path, 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// hw_tx is discovered, and hw_rx is configured
+			if egress.HwGuaranteed != 900 || egress.Classes[1].MinBps != 90 || egress.Classes[1].MaxBps != 180 {
+				t.Errorf("GetGlobalConfig() egress = %s", egress)
+			}
+			if ingress.HwGuaranteed != 500 || ingress.Classes[2].MinBps != 30 || ingress.Classes[2].MaxBps != 200 {
+				t.Errorf("GetGlobalConfig() ingress = %s", ingress)
+			}
+
+			_, _, err = GetGlobalConfig(path, 0)
+			if err == nil {
+				t.Error("GetGlobalConfig() expect error for percentage without host bandwidth")
+			}
+		})
+	}
+}
+
+func TestGetGlobalConfigBurstable(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"global_bps_config": `hw_tx_bps_max 100
+hw_tx_bps_burstable 150
+hw_tx_burst_credit 1000`,
+		"global_bps_config.yaml": `hw_tx_bps_max: 100
+hw_tx_bps_burstable: 150
+hw_tx_burst_credit: 1000
+`,
+	}
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ingress, egress, err := GetGlobalConfig(path, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if egress.HwGuaranteed != 100 || egress.HwBurstableBps != 150 || egress.BurstCredit != 1000 {
+				t.Errorf("GetGlobalConfig() egress = %s", egress)
+			}
+			if ingress.HwBurstableBps != 0 || ingress.BurstCredit != 0 {
+				t.Errorf("GetGlobalConfig() ingress = %s", ingress)
+			}
+		})
+	}
+}
+
+func TestGetGlobalConfigEstimator(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"global_bps_config": `rate_estimator ewma
+rate_slot_width_ms 20
+rate_slot_num 4
+rate_half_life_ms 200`,
+		"global_bps_config.yaml": `rate_estimator: ewma
+rate_slot_width_ms: 20
+rate_slot_num: 4
+rate_half_life_ms: 200
+`,
+	}
+	want := types.RateEstimator{Type: types.EstimatorEWMA, SlotWidth: 20 * time.Millisecond, SlotNum: 4, HalfLife: 200 * time.Millisecond}
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ingress, egress, err := GetGlobalConfig(path, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ingress.Estimator != want || egress.Estimator != want {
+				t.Errorf("GetGlobalConfig() = %s, %s, want estimator %s", ingress, egress, &want)
+			}
+		})
+	}
+}
+
+func TestGetInterfaceConfigs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "global_bps_config.yaml")
+	contents := `hw_tx_bps_max: 100
+interfaces:
+  eth1:
+    hw_tx_bps_max: 50
+    l1_tx_bps_max: 20%
+  eth2:
+    l1_tx_bps_max: 10%
+`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	speeds := map[string]uint64{"eth2": 1000}
+	configs, err := GetInterfaceConfigs(path, func(name string) uint64 { return speeds[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("GetInterfaceConfigs() got %d interfaces, want 2", len(configs))
+	}
+	if eg := configs["eth1"].Egress; eg.HwGuaranteed != 50 || eg.Classes[1].MaxBps != 10 {
+		t.Errorf("GetInterfaceConfigs() eth1 egress = %s", eg)
+	}
+	if eg := configs["eth2"].Egress; eg.HwGuaranteed != 1000 || eg.Classes[1].MaxBps != 100 {
+		t.Errorf("GetInterfaceConfigs() eth2 egress = %s", eg)
+	}
+
+	nested := filepath.Join(dir, "nested.yaml")
+	if err := os.WriteFile(nested, []byte("interfaces:\n  eth1:\n    interfaces:\n      eth2: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetInterfaceConfigs(nested, func(string) uint64 { return 0 }); err == nil {
+		t.Error("GetInterfaceConfigs() expect error for nested interfaces")
+	}
+
+	text := filepath.Join(dir, "global_bps_config")
+	if err := os.WriteFile(text, []byte("hw_tx_bps_max 100"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if configs, err = GetInterfaceConfigs(text, func(string) uint64 { return 0 }); err != nil || configs != nil {
+		t.Errorf("GetInterfaceConfigs() of key-value config = %v, %v", configs, err)
+	}
+}
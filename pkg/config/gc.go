@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"errors"
+	"net/netip"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/metrics"
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+var _ types.GarbageCollector = &Syncer{}
+
+// GC delete entries in the pinned maps, which belong to neither alive pods nor pods in cache.
+// Entries are left over when the daemon restart, or a pod is deleted while the daemon is down.
+func (s *Syncer) GC(alive []types.PodConfig) error {
+	ips := sets.New[netip.Addr]()
+	inodes := sets.New[uint64]()
+	var uids []string
+
+	for i := range alive {
+		pod := &alive[i]
+		for _, ip := range pod.IPs {
+			ips.Insert(ip.Addr.Unmap())
+		}
+		if pod.CgroupInfo != nil {
+			inodes.Insert(pod.CgroupInfo.Inode)
+		} else if pod.PodUID != "" {
+			uids = append(uids, pod.PodUID)
+		}
+	}
+
+	// resolve cgroup before taking the lock, it walks the cgroup fs on cache miss
+	gcCgroup := true
+	for _, uid := range uids {
+		info, err := s.cgroup.GetCgroupByPodUID(uid)
+		if err != nil {
+			// don't know whether the entries are in use, try next time
+			log.Info("skip gc of cgroup entries, cgroup of pod not found", "uid", uid)
+			gcCgroup = false
+			break
+		}
+		inodes.Insert(info.Inode)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, obj := range s.podCache.List() {
+		pod := obj.(*types.PodConfig)
+		for _, ip := range pod.IPs {
+			ips.Insert(ip.Addr.Unmap())
+		}
+		if pod.CgroupInfo != nil {
+			inodes.Insert(pod.CgroupInfo.Inode)
+		}
+	}
+
+	var errs []error
+	for ip, info := range s.bpf.ListPodInfo() {
+		if ips.Has(ip.Unmap()) {
+			continue
+		}
+		if err := s.bpf.DeletePodIP(ip); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Info("gc removed stale entry", "map", "pod_map", "ip", ip.Unmap().String(), "inode", info.Inode)
+		metrics.GCRemovedTotal.WithLabelValues("pod_map").Inc()
+	}
+
+	if !gcCgroup {
+		return errors.Join(errs...)
+	}
+
+	for inode := range s.bpf.ListCgroupInfo() {
+		if inodes.Has(inode) {
+			continue
+		}
+		if err := s.bpf.DeleteCgroupInfo(inode); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Info("gc removed stale entry", "map", "cgroup_info_map", "inode", inode)
+		metrics.GCRemovedTotal.WithLabelValues("cgroup_info_map").Inc()
+	}
+
+	removed := sets.New[uint64]()
+	for id := range s.bpf.ListCgroupRate() {
+		if inodes.Has(id.Inode) || removed.Has(id.Inode) {
+			continue
+		}
+		if err := s.bpf.DeleteCgroupRate(id.Inode); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed.Insert(id.Inode)
+		log.Info("gc removed stale entry", "map", "cgroup_rate_map", "inode", id.Inode)
+		metrics.GCRemovedTotal.WithLabelValues("cgroup_rate_map").Inc()
+	}
+
+	removed = sets.New[uint64]()
+	for key := range s.bpf.ListCIDRRate() {
+		if inodes.Has(key.Inode) || removed.Has(key.Inode) {
+			continue
+		}
+		if err := s.bpf.DeleteCIDRRate(key.Inode); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed.Insert(key.Inode)
+		log.Info("gc removed stale entry", "map", "cidr_rate_map", "inode", key.Inode)
+		metrics.GCRemovedTotal.WithLabelValues("cidr_rate_map").Inc()
+	}
+
+	for inode := range s.bpf.ListPortClass() {
+		if inodes.Has(inode) {
+			continue
+		}
+		if err := s.bpf.DeletePortClass(inode); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Info("gc removed stale entry", "map", "port_class_map", "inode", inode)
+		metrics.GCRemovedTotal.WithLabelValues("port_class_map").Inc()
+	}
+
+	removed = sets.New[uint64]()
+	for id := range s.bpf.ListCgroupStat() {
+		if inodes.Has(id.Inode) || removed.Has(id.Inode) {
+			continue
+		}
+		if err := s.bpf.DeleteCgroupStat(id.Inode); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed.Insert(id.Inode)
+		log.Info("gc removed stale entry", "map", "cgroup_stat_map", "inode", id.Inode)
+		metrics.GCRemovedTotal.WithLabelValues("cgroup_stat_map").Inc()
+	}
+
+	return errors.Join(errs...)
+}
@@ -18,7 +18,10 @@ package config
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -29,47 +32,89 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"k8s.io/apimachinery/pkg/util/sets"
 
+	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
 	"github.com/AliyunContainerService/terway-qos/pkg/bpf"
+	"github.com/AliyunContainerService/terway-qos/pkg/metrics"
 	"github.com/AliyunContainerService/terway-qos/pkg/types"
 )
 
 var _ types.SyncPod = &Syncer{}
+var _ types.SyncGlobal = &Syncer{}
 
 const (
-	rootFileConfig  = "/var/lib/terway/qos"
-	perCgroupConfig = "per_cgroup_bps_limit"
-	globalConfig    = "global_bps_config"
-	podConfig       = "pod.json"
+	rootFileConfig   = "/var/lib/terway/qos"
+	perCgroupConfig  = "per_cgroup_bps_limit"
+	globalConfig     = "global_bps_config"
+	globalConfigYAML = "global_bps_config.yaml"
+	globalConfigJSON = "global_bps_config.json"
+	podConfig        = "pod.json"
+
+	// atomicWriterData is the symlink swapped by kubelet when a ConfigMap volume is updated
+	atomicWriterData = "..data"
+	debounceInterval = 500 * time.Millisecond
 )
 
 type Syncer struct {
-	globalPath    string
+	root string
+	// globalPaths in the order of preference, structured config first
+	globalPaths   []string
 	perCgroupPath string
 	podConfigPath string
 
 	bpf    bpf.Interface
 	cgroup Interface
 
+	// linkBps return the discovered link capacity, used when the host bandwidth is absent
+	linkBps func() uint64
+	// linkSpeed return the discovered capacity of an interface, for interfaces with their own config
+	linkSpeed func(name string) uint64
+
 	podCache *PodCache
+	// fileInodes is cgroups configured by each config file
+	fileInodes map[string]sets.Set[uint64]
+	// fileLimits is the limits set by the config files by cgroup, kept when the pod is updated without them
+	fileLimits map[uint64]*fileLimit
+
+	// nodeIngress and nodeEgress is set by the NodeQoSConfig, which takes precedence over the global config file
+	nodeIngress *types.GlobalConfig
+	nodeEgress  *types.GlobalConfig
 
-	lock sync.Mutex
+	lock       sync.Mutex
+	globalLock sync.Mutex
 }
 
-func NewSyncer(bpfWriter bpf.Interface) *Syncer {
+func NewSyncer(bpfWriter bpf.Interface, linkBps func() uint64, linkSpeed func(name string) uint64) *Syncer {
 	return &Syncer{
-		globalPath:    filepath.Join(rootFileConfig, globalConfig),
+		root: rootFileConfig,
+		globalPaths: []string{
+			filepath.Join(rootFileConfig, globalConfigYAML),
+			filepath.Join(rootFileConfig, globalConfigJSON),
+			filepath.Join(rootFileConfig, globalConfig),
+		},
 		perCgroupPath: filepath.Join(rootFileConfig, perCgroupConfig),
 		podConfigPath: filepath.Join(rootFileConfig, podConfig),
 
-		bpf:    bpfWriter,
-		cgroup: NewCgroup(),
+		bpf:       bpfWriter,
+		cgroup:    NewCgroupInterface(),
+		linkBps:   linkBps,
+		linkSpeed: linkSpeed,
 
-		podCache: NewPodCache(),
+		podCache:   NewPodCache(),
+		fileInodes: map[string]sets.Set[uint64]{},
+		fileLimits: map[uint64]*fileLimit{},
 	}
 }
 
+// fileLimit is the limits of a cgroup set by a config file, which annotations of the pod do not carry
+type fileLimit struct {
+	RxBurst uint64
+	TxBurst uint64
+
+	CIDRRates []types.CIDRRate
+}
+
 func (s *Syncer) Start(ctx context.Context) error {
-	err := os.MkdirAll(rootFileConfig, os.ModeDir)
+	err := os.MkdirAll(s.root, os.ModeDir)
 	if err != nil {
 		return err
 	}
@@ -78,68 +123,63 @@ func (s *Syncer) Start(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	log.Info("watching config change", "path", rootFileConfig)
-	err = watcher.Add(rootFileConfig)
+	log.Info("watching config change", "path", s.root)
+	err = watcher.Add(s.root)
 	if err != nil {
 		return err
 	}
 
 	go func() {
 		tick := time.NewTicker(5 * time.Second)
+		defer tick.Stop()
+
+		// events come in burst when a ConfigMap is updated, sync once they settle down
+		debounce := time.NewTimer(debounceInterval)
+		debounce.Stop()
+		pending := sets.New[string]()
+
+		watching := true
 
 		defer watcher.Close()
 		for {
 			select {
 			case <-ctx.Done():
-				tick.Stop()
+				debounce.Stop()
 				return
 			case event, ok := <-watcher.Events:
 				if !ok {
 					return
 				}
-				switch event.Name {
-				case rootFileConfig:
-					if event.Has(fsnotify.Remove | fsnotify.Rename) {
-						log.Info("config file gone, will restart", "event", event.String())
-						os.Exit(99)
-					}
-				case s.globalPath:
-					log.Info("cfg change", "event", event.String())
-
-					err = s.syncGlobalConfig()
-				case s.perCgroupPath:
-					log.Info("cfg change", "event", event.String())
-
-					err = s.syncCgroupRate()
-				case s.podConfigPath:
-					log.Info("cfg change", "event", event.String())
-
-					err = s.syncPodConfig()
-				default:
+				sources, gone := s.sourcesOf(event)
+				if gone {
+					// the watch is dropped with the directory, or follows it to where it is renamed
+					log.Info("config dir gone, will watch again when it is back", "event", event.String())
+					_ = watcher.Remove(s.root)
+					watching = false
 					continue
 				}
-				if err != nil {
-					log.Error(err, "error sync config")
+				if len(sources) == 0 {
+					continue
 				}
-
+				log.Info("cfg change", "event", event.String())
+				pending.Insert(sources...)
+				debounce.Reset(debounceInterval)
+			case <-debounce.C:
+				s.sync(sets.List(pending)...)
+				pending = sets.New[string]()
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
 				}
 				log.Error(err, "file watch err")
 			case <-tick.C:
-				err = s.syncGlobalConfig()
-				if err != nil {
-					log.Error(err, "error sync config")
-				}
-				err = s.syncCgroupRate()
-				if err != nil {
-					log.Error(err, "error sync config")
-				}
-				err = s.syncPodConfig()
-				if err != nil {
-					log.Error(err, "error sync config")
+				if !watching {
+					if err := watcher.Add(s.root); err == nil {
+						log.Info("watching config change", "path", s.root)
+						watching = true
+					}
 				}
+				s.sync(globalConfig, perCgroupConfig, podConfig)
 			}
 		}
 	}()
@@ -147,6 +187,67 @@ func (s *Syncer) Start(ctx context.Context) error {
 	return nil
 }
 
+// sourcesOf return config sources affected by the event, gone is true if the config dir is removed or renamed.
+// ConfigMap volume is updated by swapping the ..data symlink, which the config files link to, so all sources are synced.
+func (s *Syncer) sourcesOf(event fsnotify.Event) (sources []string, gone bool) {
+	if event.Name == s.root {
+		return nil, event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)
+	}
+	if filepath.Dir(event.Name) != s.root {
+		return nil, false
+	}
+
+	name := filepath.Base(event.Name)
+	switch {
+	case name == atomicWriterData:
+		return []string{globalConfig, perCgroupConfig, podConfig}, false
+	case strings.HasPrefix(name, ".."):
+		// timestamped dirs and the temporary symlink of atomic writer
+		return nil, false
+	case event.Name == s.perCgroupPath:
+		return []string{perCgroupConfig}, false
+	case event.Name == s.podConfigPath:
+		return []string{podConfig}, false
+	}
+	for _, path := range s.globalPaths {
+		if event.Name == path {
+			return []string{globalConfig}, false
+		}
+	}
+	return nil, false
+}
+
+// sync the sources, errors are logged and counted
+func (s *Syncer) sync(sources ...string) {
+	for _, source := range sources {
+		var err error
+		switch source {
+		case globalConfig:
+			err = s.syncGlobalConfig()
+		case perCgroupConfig:
+			err = s.syncCgroupRate()
+		case podConfig:
+			err = s.syncPodConfig()
+		}
+		if err != nil {
+			log.Error(err, "error sync config", "source", source)
+			metrics.SyncErrorsTotal.WithLabelValues(source).Inc()
+		}
+	}
+}
+
+// ListPods return a copy of all pods in cache
+func (s *Syncer) ListPods() []types.PodConfig {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var result []types.PodConfig
+	for _, obj := range s.podCache.List() {
+		result = append(result, *obj.(*types.PodConfig))
+	}
+	return result
+}
+
 func (s *Syncer) DeletePod(id string) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -189,6 +290,24 @@ func (s *Syncer) UpdatePod(config *types.PodConfig) error {
 		if config.RxBps != nil {
 			config.RxBps = prev.RxBps
 		}
+		// keep the burst and cidr rates of the config files, if not set by annotation.
+		// cidr rates no longer present are deleted by WritePodInfo
+		if file := s.fileLimitOf(prev); file != nil {
+			if config.TxBurst == 0 {
+				config.TxBurst = file.TxBurst
+			}
+			if config.RxBurst == 0 {
+				config.RxBurst = file.RxBurst
+			}
+			if len(config.CIDRRates) == 0 {
+				config.CIDRRates = file.CIDRRates
+			}
+		}
+
+		err = s.deleteStale(prev, config)
+		if err != nil {
+			return err
+		}
 	} else {
 		// new pod
 		log.Info("add new pod", "pod", config.PodID)
@@ -199,7 +318,7 @@ func (s *Syncer) UpdatePod(config *types.PodConfig) error {
 		config.CgroupInfo = cg
 	}
 
-	if prio != nil && *prio <= 2 {
+	if prio != nil && *prio < types.MaxClasses {
 		config.CgroupInfo.ClassID = *prio
 	}
 
@@ -218,16 +337,113 @@ func (s *Syncer) UpdatePod(config *types.PodConfig) error {
 	return s.bpf.WritePodInfo(config)
 }
 
+// fileLimitOf return the limits set by the config files for the pod, nil if there is none
+func (s *Syncer) fileLimitOf(config *types.PodConfig) *fileLimit {
+	if config.CgroupInfo == nil {
+		return nil
+	}
+	return s.fileLimits[config.CgroupInfo.Inode]
+}
+
+// deleteStale delete addresses and network rates of the pod, which are no longer present
+func (s *Syncer) deleteStale(prev, config *types.PodConfig) error {
+	ips := sets.New[netip.Addr]()
+	for _, ip := range config.IPs {
+		ips.Insert(ip.Addr.Unmap())
+	}
+	for _, ip := range prev.IPs {
+		if ips.Has(ip.Addr.Unmap()) {
+			continue
+		}
+		log.Info("delete stale ip", "pod", config.PodID, "ip", ip.Addr.String())
+		if err := s.bpf.DeletePodIP(ip.Addr); err != nil {
+			return err
+		}
+	}
+
+	if prev.CgroupInfo == nil {
+		return nil
+	}
+	networks := sets.New[uint32]()
+	for _, rate := range config.NetworkRates {
+		networks.Insert(rate.Network)
+	}
+	for _, rate := range prev.NetworkRates {
+		if networks.Has(rate.Network) {
+			continue
+		}
+		// zero rate delete the entry
+		err := s.bpf.WriteCgroupRate(&types.CgroupRate{Inode: prev.CgroupInfo.Inode, Network: rate.Network})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Syncer) UpdateGlobalConfig(ingress, egress *types.GlobalConfig) error {
+	s.globalLock.Lock()
+	s.nodeIngress, s.nodeEgress = ingress, egress
+	s.globalLock.Unlock()
+
+	return s.syncGlobalConfig()
+}
+
 func (s *Syncer) syncGlobalConfig() error {
-	ingress, egress, err := GetGlobalConfig(s.globalPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+	s.globalLock.Lock()
+	defer s.globalLock.Unlock()
+
+	if s.nodeIngress != nil && s.nodeEgress != nil {
+		// WriteGlobalConfig fill the default value, keep ours untouched
+		ingress, egress := *s.nodeIngress, *s.nodeEgress
+		if err := s.bpf.WriteGlobalConfig(&ingress, &egress); err != nil {
+			return err
 		}
-		return err
+		// NodeQoSConfig has no interface sections, all interfaces share it
+		return s.bpf.WriteInterfaceConfig(nil)
 	}
 
-	return s.bpf.WriteGlobalConfig(ingress, egress)
+	for _, path := range s.globalPaths {
+		interfaces, err := GetInterfaceConfigs(path, s.linkSpeed)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		// interfaces with their own config are not counted in the shared capacity
+		linkBps := s.linkBps()
+		for name := range interfaces {
+			linkBps -= min(linkBps, s.linkSpeed(name))
+		}
+
+		ingress, egress, err := GetGlobalConfig(path, linkBps)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		if err = s.bpf.WriteGlobalConfig(ingress, egress); err != nil {
+			return err
+		}
+		return s.bpf.WriteInterfaceConfig(ifindexConfigs(interfaces))
+	}
+	return nil
+}
+
+// ifindexConfigs index the configs by ifindex, interfaces absent are skipped until they are up in the next sync
+func ifindexConfigs(configs map[string]*types.InterfaceConfig) map[uint32]*types.InterfaceConfig {
+	result := make(map[uint32]*types.InterfaceConfig, len(configs))
+	for name, cfg := range configs {
+		link, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+		result[uint32(link.Index)] = cfg
+	}
+	return result
 }
 
 func (s *Syncer) syncCgroupRate() error {
@@ -235,7 +451,7 @@ func (s *Syncer) syncCgroupRate() error {
 	if err != nil {
 		return err
 	}
-	return s.podChanged(pods)
+	return s.podChanged(perCgroupConfig, pods)
 }
 
 func (s *Syncer) syncPodConfig() error {
@@ -243,17 +459,19 @@ func (s *Syncer) syncPodConfig() error {
 	if err != nil {
 		return err
 	}
-	return s.podChanged(pods)
+	return s.podChanged(podConfig, pods)
 }
 
-func (s *Syncer) podChanged(pods []Pod) error {
+// podChanged apply pods from the config file of source,
+// rates written by the source before are removed if the pod is no longer in the file.
+func (s *Syncer) podChanged(source string, pods []Pod) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	current := sets.New[uint64]()
 
 	for _, pod := range pods {
-		info, err := readCgroupInfo(pod.CgroupDir)
+		info, err := s.cgroup.GetCgroupByPath(pod.CgroupDir)
 		if err != nil {
 			log.Error(err, "error get cgroup info", "path", pod.CgroupDir)
 			continue
@@ -265,32 +483,58 @@ func (s *Syncer) podChanged(pods []Pod) error {
 			continue
 		}
 
-		if pod.Prio >= 0 && pod.Prio <= 2 {
+		if pod.Prio >= 0 && pod.Prio < types.MaxClasses {
 			prio := uint32(pod.Prio)
 			config.Prio = &prio
 			config.CgroupInfo.ClassID = prio
 		}
-		config.RxBps = &pod.QoSConfig.IngressBandwidth
-		config.TxBps = &pod.QoSConfig.EgressBandwidth
+		rx, tx := uint64(pod.QoSConfig.IngressBandwidth), uint64(pod.QoSConfig.EgressBandwidth)
+		config.RxBps = &rx
+		config.TxBps = &tx
+		config.RxBurst, config.TxBurst = uint64(pod.QoSConfig.IngressBurst), uint64(pod.QoSConfig.EgressBurst)
+		if err = errors.Join(bandwidth.ValidateBurst(config.RxBurst), bandwidth.ValidateBurst(config.TxBurst)); err != nil {
+			log.Error(err, "ignore pod, invalid burst", "cgroup", info.Path)
+			continue
+		}
+		var cidrRates []types.CIDRRate
+		if len(pod.QoSConfig.CIDRBandwidth) > 0 {
+			cidrRates, err = types.ParseCIDRRates(pod.QoSConfig.CIDRBandwidth)
+			if err != nil {
+				log.Error(err, "ignore pod, invalid cidr bandwidth", "cgroup", info.Path)
+				continue
+			}
+			config.CIDRRates = cidrRates
+		}
 
 		current.Insert(info.Inode)
+		s.fileLimits[info.Inode] = &fileLimit{RxBurst: config.RxBurst, TxBurst: config.TxBurst, CIDRRates: cidrRates}
 		err = s.podChangeLocked(config)
 		if err != nil {
 			return err
 		}
 	}
 
-	// clean up old cgroup rate
-	cgroups := s.bpf.ListCgroupRate()
-	olds := sets.New[uint64]()
-	for key := range cgroups {
-		olds.Insert(key.Inode)
-	}
-	for id := range olds.Difference(current) {
+	// clean up old cgroup and cidr rates, rates of other sources are left to themselves and gc
+	for id := range s.fileInodes[source].Difference(current) {
 		err := s.bpf.DeleteCgroupRate(id)
 		if err != nil {
 			log.Error(err, "delete cgruop rate failed", "id", strconv.Itoa(int(id)))
 		}
+		err = s.bpf.DeleteCIDRRate(id)
+		if err != nil {
+			log.Error(err, "delete cidr rate failed", "id", strconv.Itoa(int(id)))
+		}
+	}
+	s.fileInodes[source] = current
+
+	for id := range s.fileLimits {
+		configured := false
+		for _, inodes := range s.fileInodes {
+			configured = configured || inodes.Has(id)
+		}
+		if !configured {
+			delete(s.fileLimits, id)
+		}
 	}
 	return nil
 }
@@ -336,8 +580,22 @@ func (s *Syncer) parsePerCgroupConfig() ([]Pod, error) {
 			continue
 		}
 		cgroupPath := cgroupPathRe.FindString(line)
-		rx := parseConfig("rx_bps", line)
-		tx := parseConfig("tx_bps", line)
+		rx, err := parseConfig("rx_bps", line)
+		if err != nil {
+			return nil, fmt.Errorf("error parse %s, %w", cgroupPath, err)
+		}
+		tx, err := parseConfig("tx_bps", line)
+		if err != nil {
+			return nil, fmt.Errorf("error parse %s, %w", cgroupPath, err)
+		}
+		rxBurst, err := parseConfig("rx_burst", line)
+		if err != nil {
+			return nil, fmt.Errorf("error parse %s, %w", cgroupPath, err)
+		}
+		txBurst, err := parseConfig("tx_burst", line)
+		if err != nil {
+			return nil, fmt.Errorf("error parse %s, %w", cgroupPath, err)
+		}
 
 		configs = append(configs, Pod{
 			PodName:      "",
@@ -346,8 +604,10 @@ func (s *Syncer) parsePerCgroupConfig() ([]Pod, error) {
 			Prio:         -1,
 			CgroupDir:    cgroupPath,
 			QoSConfig: QoSConfig{
-				IngressBandwidth: rx,
-				EgressBandwidth:  tx,
+				IngressBandwidth: bandwidth.Bps(rx),
+				EgressBandwidth:  bandwidth.Bps(tx),
+				IngressBurst:     bandwidth.Bps(rxBurst),
+				EgressBurst:      bandwidth.Bps(txBurst),
 			},
 		})
 	}
@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
+	"github.com/AliyunContainerService/terway-qos/pkg/bpf"
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+// fakeBPF record the last config written of each pod, and the cidr rules of each cgroup
+type fakeBPF struct {
+	bpf.Interface
+	written   map[string]types.PodConfig
+	cidrRules map[uint64][]types.CIDRRate
+}
+
+func (f *fakeBPF) WritePodInfo(config *types.PodConfig) error {
+	f.written[config.PodID] = *config
+	// rules not in the config are deleted
+	if len(config.CIDRRates) == 0 {
+		return f.DeleteCIDRRate(config.CgroupInfo.Inode)
+	}
+	f.cidrRules[config.CgroupInfo.Inode] = config.CIDRRates
+	return nil
+}
+
+func (f *fakeBPF) DeleteCIDRRate(inode uint64) error {
+	delete(f.cidrRules, inode)
+	return nil
+}
+
+func (f *fakeBPF) DeletePodIP(ip netip.Addr) error { return nil }
+
+func (f *fakeBPF) WriteCgroupRate(config *types.CgroupRate) error { return nil }
+
+func (f *fakeBPF) DeleteCgroupRate(inode uint64) error { return nil }
+
+// fakeCgroup has a single pod cgroup
+type fakeCgroup struct {
+	info types.CgroupInfo
+}
+
+func (f *fakeCgroup) GetCgroupByPodUID(string) (*types.CgroupInfo, error) {
+	info := f.info
+	return &info, nil
+}
+
+func (f *fakeCgroup) GetCgroupByPath(string) (*types.CgroupInfo, error) {
+	info := f.info
+	return &info, nil
+}
+
+func (f *fakeCgroup) SetCgroupClassID(prio uint32, path string) error { return nil }
+
+func newFakeSyncer() (*Syncer, *fakeBPF) {
+	w := &fakeBPF{written: map[string]types.PodConfig{}, cidrRules: map[uint64][]types.CIDRRate{}}
+	s := NewSyncer(w, nil, nil)
+	s.cgroup = &fakeCgroup{info: types.CgroupInfo{Path: "/sys/fs/cgroup/kubepods/pod1", Inode: 1}}
+	return s, w
+}
+
+func TestSyncerSourcesOf(t *testing.T) {
+	root := "/var/lib/terway/qos"
+	s := &Syncer{
+		root: root,
+		globalPaths: []string{
+			filepath.Join(root, globalConfigYAML),
+			filepath.Join(root, globalConfigJSON),
+			filepath.Join(root, globalConfig),
+		},
+		perCgroupPath: filepath.Join(root, perCgroupConfig),
+		podConfigPath: filepath.Join(root, podConfig),
+	}
+
+	tests := []struct {
+		name    string
+		event   fsnotify.Event
+		sources []string
+		gone    bool
+	}{
+		{
+			name:    "configmap swap",
+			event:   fsnotify.Event{Name: filepath.Join(root, "..data"), Op: fsnotify.Create},
+			sources: []string{globalConfig, perCgroupConfig, podConfig},
+		},
+		{
+			name:  "configmap tmp link",
+			event: fsnotify.Event{Name: filepath.Join(root, "..data_tmp"), Op: fsnotify.Rename},
+		},
+		{
+			name:  "configmap timestamped dir",
+			event: fsnotify.Event{Name: filepath.Join(root, "..2023_10_01_00_00_00.123"), Op: fsnotify.Remove},
+		},
+		{
+			name:    "global yaml",
+			event:   fsnotify.Event{Name: filepath.Join(root, globalConfigYAML), Op: fsnotify.Write},
+			sources: []string{globalConfig},
+		},
+		{
+			name:    "pod",
+			event:   fsnotify.Event{Name: filepath.Join(root, podConfig), Op: fsnotify.Create},
+			sources: []string{podConfig},
+		},
+		{
+			name:  "unknown",
+			event: fsnotify.Event{Name: filepath.Join(root, "foo"), Op: fsnotify.Create},
+		},
+		{
+			name:  "dir removed",
+			event: fsnotify.Event{Name: root, Op: fsnotify.Remove},
+			gone:  true,
+		},
+		{
+			name:  "dir changed",
+			event: fsnotify.Event{Name: root, Op: fsnotify.Chmod},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources, gone := s.sourcesOf(tt.event)
+			if !reflect.DeepEqual(sources, tt.sources) || gone != tt.gone {
+				t.Errorf("sourcesOf() = %v %v, want %v %v", sources, gone, tt.sources, tt.gone)
+			}
+		})
+	}
+}
+
+// TestSyncerFileLimits check the burst and cidr rates of the pod, set by the annotations or kept from pod.json
+func TestSyncerFileLimits(t *testing.T) {
+	prio := uint32(1)
+	bps := uint64(1000 * 1000)
+	limit := bandwidth.Bps(bps)
+	rates := []types.CIDRRate{{CIDR: netip.MustParsePrefix("0.0.0.0/0"), TxBps: &bps}}
+	pod := func(txBurst uint64, rates []types.CIDRRate) *types.PodConfig {
+		return &types.PodConfig{PodID: "default/a", PodUID: "1", Prio: &prio, TxBurst: txBurst, CIDRRates: rates}
+	}
+	file := func(config QoSConfig) []Pod {
+		return []Pod{{CgroupDir: "/sys/fs/cgroup/kubepods/pod1", Prio: 1, QoSConfig: config}}
+	}
+
+	// each step update the pod by the annotations, or change pod.json if update is nil
+	type step struct {
+		update *types.PodConfig
+		file   []Pod
+
+		// the limits of the pod written last, and the cidr rules left in the datapath
+		txBurst   uint64
+		cidrRates int
+		cidrRules int
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "burst added",
+			steps: []step{
+				{update: pod(0, nil)},
+				{update: pod(128*1024, nil), txBurst: 128 * 1024},
+			},
+		},
+		{
+			name: "burst updated",
+			steps: []step{
+				{update: pod(128*1024, nil), txBurst: 128 * 1024},
+				{update: pod(256*1024, nil), txBurst: 256 * 1024},
+			},
+		},
+		{
+			name: "burst removed",
+			steps: []step{
+				{update: pod(128*1024, nil), txBurst: 128 * 1024},
+				{update: pod(0, nil)},
+			},
+		},
+		{
+			name: "cidr rates added",
+			steps: []step{
+				{update: pod(0, nil)},
+				{update: pod(0, rates), cidrRates: 1, cidrRules: 1},
+			},
+		},
+		{
+			name: "cidr rates removed",
+			steps: []step{
+				{update: pod(0, rates), cidrRates: 1, cidrRules: 1},
+				{update: pod(0, nil)},
+			},
+		},
+		{
+			name: "file burst kept and removed",
+			steps: []step{
+				{update: pod(0, nil)},
+				{file: file(QoSConfig{EgressBurst: bandwidth.Bps(64 * 1024)}), txBurst: 64 * 1024},
+				{update: pod(0, nil), txBurst: 64 * 1024},
+				{file: nil, txBurst: 64 * 1024},
+				{update: pod(0, nil)},
+			},
+		},
+		{
+			name: "file cidr rates kept and removed",
+			steps: []step{
+				{update: pod(0, nil)},
+				{file: file(QoSConfig{CIDRBandwidth: map[string]types.CIDRBandwidth{"0.0.0.0/0": {Egress: &limit}}}), cidrRates: 1, cidrRules: 1},
+				{update: pod(0, nil), cidrRates: 1, cidrRules: 1},
+				{file: nil, cidrRates: 1},
+				{update: pod(0, nil)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, w := newFakeSyncer()
+			for i, st := range tt.steps {
+				var err error
+				if st.update != nil {
+					err = s.UpdatePod(st.update)
+				} else {
+					err = s.podChanged(podConfig, st.file)
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				written := w.written["default/a"]
+				if written.TxBurst != st.txBurst || len(written.CIDRRates) != st.cidrRates {
+					t.Errorf("step %d: TxBurst = %d, CIDRRates = %d rules, want %d, %d",
+						i, written.TxBurst, len(written.CIDRRates), st.txBurst, st.cidrRates)
+				}
+				if got := len(w.cidrRules[1]); got != st.cidrRules {
+					t.Errorf("step %d: %d cidr rules in the datapath, want %d", i, got, st.cidrRules)
+				}
+			}
+		})
+	}
+}
@@ -1,20 +1,159 @@
 package config
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+// Node is the structured format of global_bps_config, in yaml or json
 type Node struct {
-	HwTxBpsMax uint64 `json:"hw_tx_bps_max" yaml:"hw_tx_bps_max"`
-	HwRxBpsMax uint64 `json:"hw_rx_bps_max" yaml:"hw_rx_bps_max"`
-	L0TxBpsMin uint64 `json:"l0_tx_bps_min" yaml:"l0_tx_bps_min"`
-	L0TxBpsMax uint64 `json:"l0_tx_bps_max" yaml:"l0_tx_bps_max"`
-	L0RxBpsMin uint64 `json:"l0_rx_bps_min" yaml:"l0_rx_bps_min"`
-	L0RxBpsMax uint64 `json:"l0_rx_bps_max" yaml:"l0_rx_bps_max"`
-	L1TxBpsMin uint64 `json:"l1_tx_bps_min" yaml:"l1_tx_bps_min"`
-	L1TxBpsMax uint64 `json:"l1_tx_bps_max" yaml:"l1_tx_bps_max"`
-	L1RxBpsMin uint64 `json:"l1_rx_bps_min" yaml:"l1_rx_bps_min"`
-	L1RxBpsMax uint64 `json:"l1_rx_bps_max" yaml:"l1_rx_bps_max"`
-	L2TxBpsMin uint64 `json:"l2_tx_bps_min" yaml:"l2_tx_bps_min"`
-	L2TxBpsMax uint64 `json:"l2_tx_bps_max" yaml:"l2_tx_bps_max"`
-	L2RxBpsMin uint64 `json:"l2_rx_bps_min" yaml:"l2_rx_bps_min"`
-	L2RxBpsMax uint64 `json:"l2_rx_bps_max" yaml:"l2_rx_bps_max"`
+	AdjustIntervalMs uint64 `json:"adjust_interval_ms" yaml:"adjust_interval_ms"`
+
+	// RateEstimator is window or ewma, the throughput is estimated every slot
+	RateEstimator   string `json:"rate_estimator" yaml:"rate_estimator"`
+	RateSlotWidthMs uint64 `json:"rate_slot_width_ms" yaml:"rate_slot_width_ms"`
+	RateSlotNum     uint32 `json:"rate_slot_num" yaml:"rate_slot_num"`
+	RateHalfLifeMs  uint64 `json:"rate_half_life_ms" yaml:"rate_half_life_ms"`
+
+	HwTxBpsMax bandwidth.Bps `json:"hw_tx_bps_max" yaml:"hw_tx_bps_max"`
+	HwRxBpsMax bandwidth.Bps `json:"hw_rx_bps_max" yaml:"hw_rx_bps_max"`
+
+	// HwTxBpsBurstable and HwRxBpsBurstable is the host bandwidth while there is burst credit
+	HwTxBpsBurstable bandwidth.Bps `json:"hw_tx_bps_burstable" yaml:"hw_tx_bps_burstable"`
+	HwRxBpsBurstable bandwidth.Bps `json:"hw_rx_bps_burstable" yaml:"hw_rx_bps_burstable"`
+	// HwTxBurstCredit and HwRxBurstCredit is the max bytes earned under the host bandwidth, 0 to disable bursting
+	HwTxBurstCredit bandwidth.Bps `json:"hw_tx_burst_credit" yaml:"hw_tx_burst_credit"`
+	HwRxBurstCredit bandwidth.Bps `json:"hw_rx_burst_credit" yaml:"hw_rx_burst_credit"`
+
+	// HwBpsHeadroomPercent is reserved from the discovered link capacity, when hw bps is absent
+	HwBpsHeadroomPercent uint64 `json:"hw_bps_headroom_percent" yaml:"hw_bps_headroom_percent"`
+
+	L0TxBpsMin bandwidth.Limit `json:"l0_tx_bps_min" yaml:"l0_tx_bps_min"`
+	L0TxBpsMax bandwidth.Limit `json:"l0_tx_bps_max" yaml:"l0_tx_bps_max"`
+	L0RxBpsMin bandwidth.Limit `json:"l0_rx_bps_min" yaml:"l0_rx_bps_min"`
+	L0RxBpsMax bandwidth.Limit `json:"l0_rx_bps_max" yaml:"l0_rx_bps_max"`
+	L1TxBpsMin bandwidth.Limit `json:"l1_tx_bps_min" yaml:"l1_tx_bps_min"`
+	L1TxBpsMax bandwidth.Limit `json:"l1_tx_bps_max" yaml:"l1_tx_bps_max"`
+	L1RxBpsMin bandwidth.Limit `json:"l1_rx_bps_min" yaml:"l1_rx_bps_min"`
+	L1RxBpsMax bandwidth.Limit `json:"l1_rx_bps_max" yaml:"l1_rx_bps_max"`
+	L2TxBpsMin bandwidth.Limit `json:"l2_tx_bps_min" yaml:"l2_tx_bps_min"`
+	L2TxBpsMax bandwidth.Limit `json:"l2_tx_bps_max" yaml:"l2_tx_bps_max"`
+	L2RxBpsMin bandwidth.Limit `json:"l2_rx_bps_min" yaml:"l2_rx_bps_min"`
+	L2RxBpsMax bandwidth.Limit `json:"l2_rx_bps_max" yaml:"l2_rx_bps_max"`
+
+	// Classes of lower priority than L2, the first one is L3
+	Classes []NodeClass `json:"classes,omitempty" yaml:"classes,omitempty"`
+
+	// Interfaces have their own budget and throughput sample by name, others share the config above
+	Interfaces map[string]*Node `json:"interfaces,omitempty" yaml:"interfaces,omitempty"`
+}
+
+// NodeClass is the bandwidth of a priority class
+type NodeClass struct {
+	TxBpsMin bandwidth.Limit `json:"tx_bps_min" yaml:"tx_bps_min"`
+	TxBpsMax bandwidth.Limit `json:"tx_bps_max" yaml:"tx_bps_max"`
+	RxBpsMin bandwidth.Limit `json:"rx_bps_min" yaml:"rx_bps_min"`
+	RxBpsMax bandwidth.Limit `json:"rx_bps_max" yaml:"rx_bps_max"`
+}
+
+// GlobalConfig convert to ingress and egress config, linkBps is the discovered link capacity
+func (n *Node) GlobalConfig(linkBps uint64) (*types.GlobalConfig, *types.GlobalConfig, error) {
+	if n.HwBpsHeadroomPercent > 100 {
+		return nil, nil, fmt.Errorf("invalid hw_bps_headroom_percent %d, expect 0 to 100", n.HwBpsHeadroomPercent)
+	}
+	interval := time.Duration(n.AdjustIntervalMs) * time.Millisecond
+	estimator := types.RateEstimator{
+		Type:      n.RateEstimator,
+		SlotWidth: time.Duration(n.RateSlotWidthMs) * time.Millisecond,
+		SlotNum:   n.RateSlotNum,
+		HalfLife:  time.Duration(n.RateHalfLifeMs) * time.Millisecond,
+	}
+
+	ingress := &types.GlobalConfig{
+		Interval:       interval,
+		Estimator:      estimator,
+		HwGuaranteed:   hwFromLink(uint64(n.HwRxBpsMax), linkBps, n.HwBpsHeadroomPercent),
+		HwBurstableBps: uint64(n.HwRxBpsBurstable),
+		BurstCredit:    uint64(n.HwRxBurstCredit),
+	}
+	egress := &types.GlobalConfig{
+		Interval:       interval,
+		Estimator:      estimator,
+		HwGuaranteed:   hwFromLink(uint64(n.HwTxBpsMax), linkBps, n.HwBpsHeadroomPercent),
+		HwBurstableBps: uint64(n.HwTxBpsBurstable),
+		BurstCredit:    uint64(n.HwTxBurstCredit),
+	}
+
+	if len(n.Classes) > types.MaxClasses-types.DefaultClasses {
+		return nil, nil, fmt.Errorf("too many classes %d, at most %d", len(n.Classes), types.MaxClasses-types.DefaultClasses)
+	}
+
+	type classKey struct {
+		key   string
+		cfg   *types.GlobalConfig
+		prio  int
+		max   bool
+		limit bandwidth.Limit
+	}
+	keys := []classKey{
+		{"l0_rx_bps_min", ingress, 0, false, n.L0RxBpsMin},
+		{"l0_rx_bps_max", ingress, 0, true, n.L0RxBpsMax},
+		{"l1_rx_bps_min", ingress, 1, false, n.L1RxBpsMin},
+		{"l1_rx_bps_max", ingress, 1, true, n.L1RxBpsMax},
+		{"l2_rx_bps_min", ingress, 2, false, n.L2RxBpsMin},
+		{"l2_rx_bps_max", ingress, 2, true, n.L2RxBpsMax},
+
+		{"l0_tx_bps_min", egress, 0, false, n.L0TxBpsMin},
+		{"l0_tx_bps_max", egress, 0, true, n.L0TxBpsMax},
+		{"l1_tx_bps_min", egress, 1, false, n.L1TxBpsMin},
+		{"l1_tx_bps_max", egress, 1, true, n.L1TxBpsMax},
+		{"l2_tx_bps_min", egress, 2, false, n.L2TxBpsMin},
+		{"l2_tx_bps_max", egress, 2, true, n.L2TxBpsMax},
+	}
+	for i, class := range n.Classes {
+		prio := types.DefaultClasses + i
+		keys = append(keys,
+			classKey{fmt.Sprintf("classes[%d].rx_bps_min", i), ingress, prio, false, class.RxBpsMin},
+			classKey{fmt.Sprintf("classes[%d].rx_bps_max", i), ingress, prio, true, class.RxBpsMax},
+			classKey{fmt.Sprintf("classes[%d].tx_bps_min", i), egress, prio, false, class.TxBpsMin},
+			classKey{fmt.Sprintf("classes[%d].tx_bps_max", i), egress, prio, true, class.TxBpsMax},
+		)
+	}
+
+	for _, kv := range keys {
+		v, err := resolveLimit(kv.key, kv.limit, kv.cfg.HwGuaranteed)
+		if err != nil {
+			return nil, nil, err
+		}
+		if kv.max {
+			kv.cfg.Class(kv.prio).MaxBps = v
+		} else {
+			kv.cfg.Class(kv.prio).MinBps = v
+		}
+	}
+	return ingress, egress, nil
+}
+
+// InterfaceConfigs convert the config of each interface, percentages are relative to the link speed of the interface
+func (n *Node) InterfaceConfigs(linkSpeed func(name string) uint64) (map[string]*types.InterfaceConfig, error) {
+	result := make(map[string]*types.InterfaceConfig, len(n.Interfaces))
+	for name, node := range n.Interfaces {
+		if node == nil {
+			continue
+		}
+		if len(node.Interfaces) > 0 {
+			return nil, fmt.Errorf("interfaces[%s]: nested interfaces is not allowed", name)
+		}
+		ingress, egress, err := node.GlobalConfig(linkSpeed(name))
+		if err != nil {
+			return nil, fmt.Errorf("interfaces[%s]: %w", name, err)
+		}
+		result[name] = &types.InterfaceConfig{Ingress: ingress, Egress: egress}
+	}
+	return result, nil
 }
 
 type Pod struct {
@@ -27,6 +166,11 @@ type Pod struct {
 }
 
 type QoSConfig struct {
-	IngressBandwidth uint64 `json:"ingressBandwidth"`
-	EgressBandwidth  uint64 `json:"egressBandwidth"`
+	IngressBandwidth bandwidth.Bps `json:"ingressBandwidth"`
+	EgressBandwidth  bandwidth.Bps `json:"egressBandwidth"`
+	// IngressBurst and EgressBurst are the bucket size in bytes, 0 for one second of traffic
+	IngressBurst bandwidth.Bps `json:"ingressBurst,omitempty"`
+	EgressBurst  bandwidth.Bps `json:"egressBurst,omitempty"`
+	// CIDRBandwidth limit traffic to or from the peers in a cidr, keyed by cidr
+	CIDRBandwidth map[string]types.CIDRBandwidth `json:"cidrBandwidth,omitempty"`
 }
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+const (
+	qosClassAnnotation = "k8s.aliyun.com/qos-class"
+	// portClassAnnotation classify traffic of the pod by protocol and port, the first match wins
+	portClassAnnotation = "k8s.aliyun.com/port-qos-class"
+)
+
+// portClass is a rule of the port class annotation, exactly one of Port and PeerPort is set
+type portClass struct {
+	// Protocol is tcp or udp, empty for both
+	Protocol string `json:"protocol,omitempty"`
+	// Port and PeerPort are a port or a range, e.g. 8080, 9090-9100
+	Port     string `json:"port,omitempty"`
+	PeerPort string `json:"peerPort,omitempty"`
+	QoSClass string `json:"qosClass"`
+}
+
+// DefaultClassNames map the qos class annotation to the priority class
+var DefaultClassNames = map[string]uint32{
+	"guaranteed":  0,
+	"burstable":   1,
+	"best-effort": 2,
+}
+
+// ParseClassNames parse the name to priority table, e.g. {"gold": "3"}. The defaults are kept unless overridden.
+func ParseClassNames(names map[string]string) (map[string]uint32, error) {
+	result := make(map[string]uint32, len(DefaultClassNames)+len(names))
+	for name, prio := range DefaultClassNames {
+		result[name] = prio
+	}
+	for name, v := range names {
+		prio, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || prio >= types.MaxClasses {
+			return nil, fmt.Errorf("invalid priority %q of qos class %s, expect 0 to %d", v, name, types.MaxClasses-1)
+		}
+		result[name] = uint32(prio)
+	}
+	return result, nil
+}
+
+// getPrio return the priority of the pod by the qos class annotation, nil if not set or unknown
+func getPrio(pod *corev1.Pod, classNames map[string]uint32) *uint32 {
+	name, ok := pod.Annotations[qosClassAnnotation]
+	if !ok {
+		return nil
+	}
+	prio, ok := classNames[name]
+	if !ok {
+		klog.Warningf("unknown qos class %s of pod %s/%s", name, pod.Namespace, pod.Name)
+		return nil
+	}
+	return &prio
+}
+
+// getPortClasses return the port rules of the pod by the port class annotation
+func getPortClasses(pod *corev1.Pod, classNames map[string]uint32) ([]types.PortClass, error) {
+	v, ok := pod.Annotations[portClassAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var rules []portClass
+	if err := json.Unmarshal([]byte(v), &rules); err != nil {
+		return nil, fmt.Errorf("error parse %s, %w", portClassAnnotation, err)
+	}
+	if len(rules) > types.MaxPortClasses {
+		return nil, fmt.Errorf("too many rules %d in %s, at most %d", len(rules), portClassAnnotation, types.MaxPortClasses)
+	}
+
+	var result []types.PortClass
+	for i, rule := range rules {
+		c := types.PortClass{Peer: rule.PeerPort != ""}
+		switch strings.ToLower(rule.Protocol) {
+		case "":
+		case "tcp":
+			c.Protocol = unix.IPPROTO_TCP
+		case "udp":
+			c.Protocol = unix.IPPROTO_UDP
+		default:
+			return nil, fmt.Errorf("invalid protocol %q of rule %d in %s, expect tcp or udp", rule.Protocol, i, portClassAnnotation)
+		}
+
+		port := rule.Port
+		if (rule.Port == "") == (rule.PeerPort == "") {
+			return nil, fmt.Errorf("rule %d in %s must set exactly one of port and peerPort", i, portClassAnnotation)
+		}
+		if c.Peer {
+			port = rule.PeerPort
+		}
+		var err error
+		c.PortMin, c.PortMax, err = parsePortRange(port)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d in %s, %w", i, portClassAnnotation, err)
+		}
+
+		prio, ok := classNames[rule.QoSClass]
+		if !ok {
+			return nil, fmt.Errorf("unknown qos class %q of rule %d in %s", rule.QoSClass, i, portClassAnnotation)
+		}
+		c.Class = prio
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// parsePortRange parse a port or a range like 9090-9100
+func parsePortRange(s string) (uint16, uint16, error) {
+	lo, hi, found := strings.Cut(s, "-")
+	from, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	to := from
+	if found {
+		to, err = strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if err != nil || to < from {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return uint16(from), uint16(to), nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+func TestParseClassNames(t *testing.T) {
+	names, err := ParseClassNames(map[string]string{"gold": "3", "best-effort": "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]uint32{"guaranteed": 0, "burstable": 1, "best-effort": 4, "gold": 3} {
+		if names[name] != want {
+			t.Errorf("class %s = %d, want %d", name, names[name], want)
+		}
+	}
+
+	for _, v := range []string{"8", "-1", "gold"} {
+		if _, err = ParseClassNames(map[string]string{"gold": v}); err == nil {
+			t.Errorf("ParseClassNames(%q) expect error", v)
+		}
+	}
+}
+
+func TestGetPrio(t *testing.T) {
+	names, _ := ParseClassNames(map[string]string{"gold": "3"})
+	pod := func(class string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{qosClassAnnotation: class}}}
+	}
+	if prio := getPrio(pod("gold"), names); prio == nil || *prio != 3 {
+		t.Errorf("getPrio(gold) = %v, want 3", prio)
+	}
+	if prio := getPrio(pod("silver"), names); prio != nil {
+		t.Errorf("getPrio(silver) = %d, want nil", *prio)
+	}
+	if prio := getPrio(&corev1.Pod{}, names); prio != nil {
+		t.Errorf("getPrio() = %d, want nil", *prio)
+	}
+}
+
+func TestGetPortClasses(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		portClassAnnotation: `[{"protocol": "tcp", "port": "9090-9100", "qosClass": "best-effort"}, {"peerPort": "514", "qosClass": "burstable"}]`,
+	}}}
+	want := []types.PortClass{
+		{Protocol: unix.IPPROTO_TCP, PortMin: 9090, PortMax: 9100, Class: 2},
+		{Peer: true, PortMin: 514, PortMax: 514, Class: 1},
+	}
+	got, err := getPortClasses(pod, DefaultClassNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getPortClasses() = %v, want %v", got, want)
+	}
+
+	for _, v := range []string{
+		`[{"protocol": "sctp", "port": "80", "qosClass": "burstable"}]`,
+		`[{"port": "80", "peerPort": "81", "qosClass": "burstable"}]`,
+		`[{"port": "90-80", "qosClass": "burstable"}]`,
+		`[{"port": "65536", "qosClass": "burstable"}]`,
+		`[{"port": "80", "qosClass": "gold"}]`,
+	} {
+		pod.Annotations[portClassAnnotation] = v
+		if _, err = getPortClasses(pod, DefaultClassNames); err == nil {
+			t.Errorf("getPortClasses(%s) expect error", v)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+const gcInterval = 5 * time.Minute
+
+var _ manager.Runnable = &podGC{}
+var _ manager.LeaderElectionRunnable = &podGC{}
+
+// podGC periodically list pods on this node, and delete datapath entries of pods no longer exist
+type podGC struct {
+	client client.Client
+	gc     types.GarbageCollector
+}
+
+// Start is called after the cache synced
+func (g *podGC) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		err := g.run(ctx)
+		if err != nil {
+			klog.Errorf("gc failed, %v", err)
+		}
+	}, gcInterval)
+	return nil
+}
+
+func (g *podGC) NeedLeaderElection() bool {
+	return false
+}
+
+func (g *podGC) run(ctx context.Context) error {
+	pods := &corev1.PodList{}
+	// the cache only contains pods on this node
+	err := g.client.List(ctx, pods)
+	if err != nil {
+		return fmt.Errorf("error list pods, %w", err)
+	}
+
+	return g.gc.GC(alivePods(pods.Items))
+}
+
+// alivePods return pods may still have entries in use, ips of completed pods are released
+func alivePods(pods []corev1.Pod) []types.PodConfig {
+	var result []types.PodConfig
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		ips := getIPs(pod)
+		if len(ips) == 0 {
+			continue
+		}
+		result = append(result, types.PodConfig{
+			PodID:       fmt.Sprintf("%s/%s", pod.Namespace, pod.Name),
+			PodUID:      string(pod.UID),
+			IPs:         ips,
+			HostNetwork: pod.Spec.HostNetwork,
+		})
+	}
+	return result
+}
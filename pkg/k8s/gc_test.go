@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func Test_alivePods(t *testing.T) {
+	newPod := func(name string, phase corev1.PodPhase, ips ...string) corev1.Pod {
+		pod := corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID("uid-" + name)},
+			Status:     corev1.PodStatus{Phase: phase},
+		}
+		for _, ip := range ips {
+			pod.Status.PodIPs = append(pod.Status.PodIPs, corev1.PodIP{IP: ip})
+		}
+		return pod
+	}
+	pods := []corev1.Pod{
+		newPod("running", corev1.PodRunning, "192.168.0.1", "fd00::1"),
+		newPod("pending", corev1.PodPending),
+		newPod("succeeded", corev1.PodSucceeded, "192.168.0.2"),
+		newPod("failed", corev1.PodFailed, "192.168.0.3"),
+	}
+
+	got := alivePods(pods)
+	if len(got) != 1 {
+		t.Fatalf("alivePods() = %v, want only the running pod", got)
+	}
+	if got[0].PodID != "default/running" || len(got[0].IPs) != 2 {
+		t.Errorf("alivePods() = %+v", got[0])
+	}
+}
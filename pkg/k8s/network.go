@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// networkStatusAnnotation is written by multus, list networks attached to the pod
+	networkStatusAnnotation = "k8s.v1.cni.cncf.io/network-status"
+	// networkBandwidthAnnotation set limits of secondary networks, keyed by network name
+	networkBandwidthAnnotation = "k8s.aliyun.com/network-bandwidth"
+	// cidrBandwidthAnnotation set limits to or from the peers in a cidr, keyed by cidr
+	cidrBandwidthAnnotation = "k8s.aliyun.com/cidr-bandwidth"
+)
+
+type networkStatus struct {
+	Name      string   `json:"name"`
+	Interface string   `json:"interface,omitempty"`
+	IPs       []string `json:"ips,omitempty"`
+	Default   bool     `json:"default,omitempty"`
+}
+
+type networkBandwidth struct {
+	Ingress bandwidth.Bps `json:"ingress"`
+	Egress  bandwidth.Bps `json:"egress"`
+}
+
+// secondaryNetworks parse the network status of the pod, networks except the default one are numbered from 1 in order
+func secondaryNetworks(pod *corev1.Pod) ([]networkStatus, error) {
+	v, ok := pod.Annotations[networkStatusAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var status []networkStatus
+	if err := json.Unmarshal([]byte(v), &status); err != nil {
+		return nil, fmt.Errorf("error parse %s, %w", networkStatusAnnotation, err)
+	}
+	var result []networkStatus
+	for _, s := range status {
+		if s.Default {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// getIPs return all addresses of the pod. Addresses in pod status belong to the default network,
+// addresses of secondary networks are taken from the network status annotation.
+func getIPs(pod *corev1.Pod) []types.PodIP {
+	var result []types.PodIP
+	seen := map[netip.Addr]bool{}
+	add := func(ip string, network uint32) {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return
+		}
+		addr = addr.Unmap()
+		if seen[addr] {
+			return
+		}
+		seen[addr] = true
+		result = append(result, types.PodIP{Addr: addr, Network: network})
+	}
+
+	for _, ip := range pod.Status.PodIPs {
+		add(ip.IP, 0)
+	}
+	if pod.Spec.HostNetwork {
+		return result
+	}
+
+	// a malformed annotation only lose the secondary networks
+	networks, _ := secondaryNetworks(pod)
+	for i, n := range networks {
+		for _, ip := range n.IPs {
+			add(ip, uint32(i+1))
+		}
+	}
+	return result
+}
+
+// getNetworkRates return limits of secondary networks. Networks not attached to the pod are ignored.
+func getNetworkRates(pod *corev1.Pod) ([]types.NetworkRate, error) {
+	v, ok := pod.Annotations[networkBandwidthAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	limits := map[string]networkBandwidth{}
+	if err := json.Unmarshal([]byte(v), &limits); err != nil {
+		return nil, fmt.Errorf("error parse %s, %w", networkBandwidthAnnotation, err)
+	}
+	networks, err := secondaryNetworks(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []types.NetworkRate
+	for i, n := range networks {
+		limit, ok := limits[n.Name]
+		if !ok || (limit.Ingress == 0 && limit.Egress == 0) {
+			continue
+		}
+		result = append(result, types.NetworkRate{
+			Network: uint32(i + 1),
+			RxBps:   uint64(limit.Ingress),
+			TxBps:   uint64(limit.Egress),
+		})
+	}
+	return result, nil
+}
+
+// getCIDRRates return limits to or from the peers in a cidr
+func getCIDRRates(pod *corev1.Pod) ([]types.CIDRRate, error) {
+	v, ok := pod.Annotations[cidrBandwidthAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	limits := map[string]types.CIDRBandwidth{}
+	if err := json.Unmarshal([]byte(v), &limits); err != nil {
+		return nil, fmt.Errorf("error parse %s, %w", cidrBandwidthAnnotation, err)
+	}
+	rates, err := types.ParseCIDRRates(limits)
+	if err != nil {
+		return nil, fmt.Errorf("error parse %s, %w", cidrBandwidthAnnotation, err)
+	}
+	return rates, nil
+}
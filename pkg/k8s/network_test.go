@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+func Test_getIPsAndNetworkRates(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				networkStatusAnnotation: `[
+{"name": "terway", "interface": "eth0", "ips": ["192.168.0.1", "fd00::1"], "default": true},
+{"name": "default/macvlan", "interface": "net1", "ips": ["10.0.0.1"]},
+{"name": "default/sriov", "interface": "net2", "ips": ["10.1.0.1", "10.1.0.2"]}]`,
+				networkBandwidthAnnotation: `{"default/sriov": {"ingress": "1Gbit", "egress": "100M"}, "default/absent": {"egress": "1M"}}`,
+			},
+		},
+		Status: corev1.PodStatus{
+			PodIPs: []corev1.PodIP{{IP: "192.168.0.1"}, {IP: "192.168.0.2"}, {IP: "fd00::1"}},
+		},
+	}
+
+	wantIPs := []types.PodIP{
+		{Addr: netip.MustParseAddr("192.168.0.1")},
+		{Addr: netip.MustParseAddr("192.168.0.2")},
+		{Addr: netip.MustParseAddr("fd00::1")},
+		{Addr: netip.MustParseAddr("10.0.0.1"), Network: 1},
+		{Addr: netip.MustParseAddr("10.1.0.1"), Network: 2},
+		{Addr: netip.MustParseAddr("10.1.0.2"), Network: 2},
+	}
+	if got := getIPs(pod); !reflect.DeepEqual(got, wantIPs) {
+		t.Errorf("getIPs() = %v, want %v", got, wantIPs)
+	}
+
+	wantRates := []types.NetworkRate{{Network: 2, RxBps: 125000000, TxBps: 100000000}}
+	got, err := getNetworkRates(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, wantRates) {
+		t.Errorf("getNetworkRates() = %v, want %v", got, wantRates)
+	}
+
+	pod.Annotations[networkBandwidthAnnotation] = `{"default/sriov": {"egress": "1x"}}`
+	if _, err = getNetworkRates(pod); err == nil {
+		t.Error("getNetworkRates() expect error for invalid bandwidth")
+	}
+}
+
+func Test_getCIDRRates(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				cidrBandwidthAnnotation: `{"0.0.0.0/0": {"egress": "10M"}, "10.1.2.3/8": {"egress": 0}, "fd00::/8": {}}`,
+			},
+		},
+	}
+	tenM, zero := uint64(10000000), uint64(0)
+	want := []types.CIDRRate{
+		{CIDR: netip.MustParsePrefix("0.0.0.0/0"), TxBps: &tenM},
+		{CIDR: netip.MustParsePrefix("10.0.0.0/8"), TxBps: &zero},
+	}
+	got, err := getCIDRRates(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getCIDRRates() = %v, want %v", got, want)
+	}
+
+	pod.Annotations[cidrBandwidthAnnotation] = `{"10.0.0.0/33": {"egress": "1M"}}`
+	if _, err = getCIDRRates(pod); err == nil {
+		t.Error("getCIDRRates() expect error for invalid cidr")
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	qosv1alpha1 "github.com/AliyunContainerService/terway-qos/pkg/apis/qos/v1alpha1"
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+// reconcileNodeQoSConfig pick the NodeQoSConfig matching the node, and write it to the datapath
+type reconcileNodeQoSConfig struct {
+	client client.Client
+	// reader read from the api server, used when status update conflict
+	reader client.Reader
+
+	nodeName string
+	syncer   types.SyncGlobal
+}
+
+var _ reconcile.Reconciler = &reconcileNodeQoSConfig{}
+
+func (r *reconcileNodeQoSConfig) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	node := &corev1.Node{}
+	err := r.client.Get(ctx, client.ObjectKey{Name: r.nodeName}, node)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	configs := &qosv1alpha1.NodeQoSConfigList{}
+	err = r.client.List(ctx, configs)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	matched := matchNodeQoSConfigs(configs.Items, labels.Set(node.Labels))
+
+	// only the applied config and the ones failed on this node carry the status of the node,
+	// so a config selecting many nodes is not updated by the nodes preferring another one
+	status := map[string]*qosv1alpha1.NodeStatus{}
+	for _, cfg := range matched {
+		st := &qosv1alpha1.NodeStatus{
+			NodeName:           r.nodeName,
+			ObservedGeneration: cfg.Generation,
+		}
+		status[cfg.Name] = st
+
+		ingress, egress := globalConfigFromNodeQoSConfig(cfg)
+		errs := ingress.Validate(field.NewPath("spec", "ingress"))
+		errs = append(errs, egress.Validate(field.NewPath("spec", "egress"))...)
+		if len(errs) > 0 {
+			// keep the previous config, and try the next one
+			st.Message = errs.ToAggregate().Error()
+			continue
+		}
+
+		err = r.syncer.UpdateGlobalConfig(ingress, egress)
+		if err != nil {
+			st.Message = err.Error()
+			continue
+		}
+		klog.Infof("node qos config %s applied", cfg.Name)
+		st.Applied = true
+		break
+	}
+	if len(matched) == 0 {
+		err = r.syncer.UpdateGlobalConfig(nil, nil)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	for i := range configs.Items {
+		st := status[configs.Items[i].Name]
+		if st == nil && !hasNodeStatus(configs.Items[i].Status.Nodes, r.nodeName) {
+			continue
+		}
+		err = r.updateStatus(ctx, &configs.Items[i], st)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	return reconcile.Result{}, nil
+}
+
+// updateStatus set status of this node, remove it if st is nil
+func (r *reconcileNodeQoSConfig) updateStatus(ctx context.Context, cfg *qosv1alpha1.NodeQoSConfig, st *qosv1alpha1.NodeStatus) error {
+	first := true
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if !first {
+			err := r.reader.Get(ctx, client.ObjectKeyFromObject(cfg), cfg)
+			if err != nil {
+				return client.IgnoreNotFound(err)
+			}
+		}
+		first = false
+
+		nodes, changed := setNodeStatus(cfg.Status.Nodes, r.nodeName, st)
+		if !changed {
+			return nil
+		}
+		update := cfg.DeepCopy()
+		update.Status.Nodes = nodes
+		return client.IgnoreNotFound(r.client.Status().Update(ctx, update))
+	})
+}
+
+// hasNodeStatus return whether the node is listed, the stale one is removed once the config is no longer applied
+func hasNodeStatus(nodes []qosv1alpha1.NodeStatus, nodeName string) bool {
+	for _, n := range nodes {
+		if n.NodeName == nodeName {
+			return true
+		}
+	}
+	return false
+}
+
+// setNodeStatus replace the status of the node, or remove it if st is nil.
+// LastUpdateTime is only refreshed when the status changed.
+func setNodeStatus(nodes []qosv1alpha1.NodeStatus, nodeName string, st *qosv1alpha1.NodeStatus) ([]qosv1alpha1.NodeStatus, bool) {
+	result := make([]qosv1alpha1.NodeStatus, 0, len(nodes)+1)
+	changed := false
+	found := false
+	for _, n := range nodes {
+		if n.NodeName != nodeName {
+			result = append(result, n)
+			continue
+		}
+		found = true
+		if st == nil {
+			changed = true
+			continue
+		}
+		if n.Applied == st.Applied && n.Message == st.Message && n.ObservedGeneration == st.ObservedGeneration {
+			result = append(result, n)
+			continue
+		}
+		changed = true
+		s := *st
+		s.LastUpdateTime = metav1.Now()
+		result = append(result, s)
+	}
+	if st != nil && !found {
+		changed = true
+		s := *st
+		s.LastUpdateTime = metav1.Now()
+		result = append(result, s)
+	}
+	return result, changed
+}
+
+// matchNodeQoSConfigs return configs selecting the node, in the order of preference
+func matchNodeQoSConfigs(configs []qosv1alpha1.NodeQoSConfig, nodeLabels labels.Set) []*qosv1alpha1.NodeQoSConfig {
+	var result []*qosv1alpha1.NodeQoSConfig
+	for i := range configs {
+		cfg := &configs[i]
+		if !cfg.DeletionTimestamp.IsZero() {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(&cfg.Spec.NodeSelector)
+		if err != nil {
+			klog.Errorf("invalid node selector of node qos config %s, %v", cfg.Name, err)
+			continue
+		}
+		if selector.Matches(nodeLabels) {
+			result = append(result, cfg)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Spec.Priority != result[j].Spec.Priority {
+			return result[i].Spec.Priority > result[j].Spec.Priority
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func globalConfigFromNodeQoSConfig(cfg *qosv1alpha1.NodeQoSConfig) (ingress, egress *types.GlobalConfig) {
+	convert := func(d *qosv1alpha1.DirectionConfig) *types.GlobalConfig {
+		c := &types.GlobalConfig{
+			HwGuaranteed:   uint64(d.HwBps),
+			HwBurstableBps: uint64(d.HwBurstableBps),
+			BurstCredit:    uint64(d.BurstCredit),
+		}
+		for _, class := range append([]qosv1alpha1.ClassConfig{d.L0, d.L1, d.L2}, d.Classes...) {
+			c.Classes = append(c.Classes, types.ClassConfig{MinBps: uint64(class.MinBps), MaxBps: uint64(class.MaxBps)})
+		}
+		if cfg.Spec.AdjustInterval != nil {
+			c.Interval = cfg.Spec.AdjustInterval.Duration
+		}
+		c.Default()
+		return c
+	}
+	return convert(&cfg.Spec.Ingress), convert(&cfg.Spec.Egress)
+}
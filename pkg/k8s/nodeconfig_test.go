@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	qosv1alpha1 "github.com/AliyunContainerService/terway-qos/pkg/apis/qos/v1alpha1"
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+func Test_matchNodeQoSConfigs(t *testing.T) {
+	newConfig := func(name string, prio int32, selector map[string]string) qosv1alpha1.NodeQoSConfig {
+		return qosv1alpha1.NodeQoSConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: qosv1alpha1.NodeQoSConfigSpec{
+				NodeSelector: metav1.LabelSelector{MatchLabels: selector},
+				Priority:     prio,
+			},
+		}
+	}
+	configs := []qosv1alpha1.NodeQoSConfig{
+		newConfig("default", 0, nil),
+		newConfig("other", 100, map[string]string{"type": "other"}),
+		newConfig("b", 10, map[string]string{"type": "large"}),
+		newConfig("a", 10, map[string]string{"type": "large"}),
+	}
+
+	got := matchNodeQoSConfigs(configs, labels.Set{"type": "large"})
+	var names []string
+	for _, cfg := range got {
+		names = append(names, cfg.Name)
+	}
+	want := []string{"a", "b", "default"}
+	if len(names) != len(want) {
+		t.Fatalf("matchNodeQoSConfigs() = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("matchNodeQoSConfigs() = %v, want %v", names, want)
+		}
+	}
+}
+
+type fakeSyncGlobal struct {
+	ingress, egress *types.GlobalConfig
+}
+
+func (f *fakeSyncGlobal) UpdateGlobalConfig(ingress, egress *types.GlobalConfig) error {
+	f.ingress, f.egress = ingress, egress
+	return nil
+}
+
+func TestReconcileNodeQoSConfigStatus(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = qosv1alpha1.AddToScheme(scheme)
+
+	newConfig := func(name string, prio int32, selector map[string]string, nodes ...string) *qosv1alpha1.NodeQoSConfig {
+		cfg := &qosv1alpha1.NodeQoSConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: qosv1alpha1.NodeQoSConfigSpec{
+				NodeSelector: metav1.LabelSelector{MatchLabels: selector},
+				Priority:     prio,
+			},
+		}
+		for _, n := range nodes {
+			cfg.Status.Nodes = append(cfg.Status.Nodes, qosv1alpha1.NodeStatus{NodeName: n, Applied: true})
+		}
+		return cfg
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"type": "large"}}},
+		newConfig("large", 10, map[string]string{"type": "large"}),
+		// shadowed by large, the stale status is removed
+		newConfig("default", 0, nil, "node-1", "node-2"),
+		newConfig("other", 0, map[string]string{"type": "other"}, "node-2"),
+	).Build()
+
+	syncer := &fakeSyncGlobal{}
+	r := &reconcileNodeQoSConfig{client: c, reader: c, nodeName: "node-1", syncer: syncer}
+	_, err := r.Reconcile(context.Background(), reconcile.Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if syncer.ingress == nil || syncer.egress == nil {
+		t.Fatalf("config is not applied")
+	}
+
+	want := map[string][]string{
+		"large":   {"node-1"},
+		"default": {"node-2"},
+		"other":   {"node-2"},
+	}
+	for name, nodes := range want {
+		cfg := &qosv1alpha1.NodeQoSConfig{}
+		err = c.Get(context.Background(), client.ObjectKey{Name: name}, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, n := range cfg.Status.Nodes {
+			got = append(got, n.NodeName)
+		}
+		if len(got) != len(nodes) || got[0] != nodes[0] {
+			t.Errorf("status of %s = %v, want %v", name, got, nodes)
+		}
+	}
+}
+
+func Test_setNodeStatus(t *testing.T) {
+	nodes := []qosv1alpha1.NodeStatus{
+		{NodeName: "node-1", Applied: true, ObservedGeneration: 1},
+		{NodeName: "node-2", Applied: true, ObservedGeneration: 1},
+	}
+
+	_, changed := setNodeStatus(nodes, "node-1", &qosv1alpha1.NodeStatus{NodeName: "node-1", Applied: true, ObservedGeneration: 1})
+	if changed {
+		t.Errorf("same status should not change")
+	}
+
+	got, changed := setNodeStatus(nodes, "node-1", &qosv1alpha1.NodeStatus{NodeName: "node-1", Message: "invalid", ObservedGeneration: 2})
+	if !changed || len(got) != 2 || got[0].Applied || got[0].Message != "invalid" || got[0].LastUpdateTime.IsZero() {
+		t.Errorf("setNodeStatus() = %v, %v", got, changed)
+	}
+
+	got, changed = setNodeStatus(nodes, "node-3", &qosv1alpha1.NodeStatus{NodeName: "node-3", Applied: true})
+	if !changed || len(got) != 3 || got[2].NodeName != "node-3" {
+		t.Errorf("setNodeStatus() = %v, %v", got, changed)
+	}
+
+	got, changed = setNodeStatus(nodes, "node-2", nil)
+	if !changed || len(got) != 1 || got[0].NodeName != "node-1" {
+		t.Errorf("setNodeStatus() = %v, %v", got, changed)
+	}
+
+	_, changed = setNodeStatus(nodes, "node-3", nil)
+	if changed {
+		t.Errorf("remove absent node should not change")
+	}
+}
+
+func Test_globalConfigFromNodeQoSConfig(t *testing.T) {
+	cfg := &qosv1alpha1.NodeQoSConfig{}
+	err := json.Unmarshal([]byte(`{"spec":{"adjustInterval":"500ms","egress":{"hwBps":"1Gbit","l1":{"minBps":"10M","maxBps":20000000},"classes":[{"maxBps":"5M"}]}}}`), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingress, egress := globalConfigFromNodeQoSConfig(cfg)
+	if ingress.HwGuaranteed != 0 || ingress.Interval.String() != "500ms" {
+		t.Errorf("unexpected ingress %s", ingress)
+	}
+	if egress.HwGuaranteed != 125000000 || egress.Classes[1].MinBps != 10000000 || egress.Classes[1].MaxBps != 20000000 || egress.Classes[0].MinBps != 115000000 ||
+		len(egress.Classes) != 4 || egress.Classes[3].MaxBps != 5000000 {
+		t.Errorf("unexpected egress %s", egress)
+	}
+}
@@ -18,17 +18,20 @@ package k8s
 import (
 	"context"
 	"fmt"
-	"net/netip"
 	"os"
 	"time"
 
+	qosv1alpha1 "github.com/AliyunContainerService/terway-qos/pkg/apis/qos/v1alpha1"
 	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
+	"github.com/AliyunContainerService/terway-qos/pkg/metrics"
 	"github.com/AliyunContainerService/terway-qos/pkg/types"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/klog/v2"
@@ -37,7 +40,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 type Interface interface {
@@ -48,9 +54,14 @@ var scheme = runtime.NewScheme()
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(qosv1alpha1.AddToScheme(scheme))
 }
 
-func StartPodHandler(ctx context.Context, syncer types.SyncPod) error {
+// StartPodHandler watch pods on this node, and collect garbage of deleted pods by gc.
+// NodeQoSConfig is watched as well if global is not nil and the CRD is installed.
+// classNames map the qos class annotation to the priority, see ParseClassNames.
+func StartPodHandler(ctx context.Context, syncer types.SyncPod, gc types.GarbageCollector, global types.SyncGlobal, classNames map[string]uint32) error {
+	nodeName := os.Getenv("K8S_NODE_NAME")
 	options := ctrl.Options{
 		Scheme: scheme,
 	}
@@ -58,7 +69,10 @@ func StartPodHandler(ctx context.Context, syncer types.SyncPod) error {
 	options.NewCache = cache.BuilderWithOptions(cache.Options{
 		SelectorsByObject: cache.SelectorsByObject{
 			&corev1.Pod{}: {
-				Field: fields.SelectorFromSet(fields.Set{"spec.nodeName": os.Getenv("K8S_NODE_NAME")}),
+				Field: fields.SelectorFromSet(fields.Set{"spec.nodeName": nodeName}),
+			},
+			&corev1.Node{}: {
+				Field: fields.SelectorFromSet(fields.Set{"metadata.name": nodeName}),
 			},
 		}},
 	)
@@ -70,12 +84,51 @@ func StartPodHandler(ctx context.Context, syncer types.SyncPod) error {
 	err = ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Pod{}, builder.WithPredicates(&predicateForPod{})).
 		Complete(&reconcilePod{
-			client: mgr.GetClient(),
-			syncer: syncer,
+			client:     mgr.GetClient(),
+			syncer:     syncer,
+			classNames: classNames,
 		})
 	if err != nil {
 		return err
 	}
+
+	err = mgr.Add(&podGC{
+		client: mgr.GetClient(),
+		gc:     gc,
+	})
+	if err != nil {
+		return err
+	}
+
+	if global != nil {
+		// helm does not install the crds on upgrade, fall back to the config file instead of crashing
+		_, err = mgr.GetRESTMapper().RESTMapping(qosv1alpha1.GroupVersion.WithKind("NodeQoSConfig").GroupKind(), qosv1alpha1.GroupVersion.Version)
+		if meta.IsNoMatchError(err) {
+			klog.Warningf("NodeQoSConfig CRD is not installed, node qos config is disabled, %v", err)
+			global = nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if global != nil {
+		// every change is reconciled as a whole for this node
+		toNode := handler.EnqueueRequestsFromMapFunc(func(client.Object) []reconcile.Request {
+			return []reconcile.Request{{NamespacedName: k8stypes.NamespacedName{Name: nodeName}}}
+		})
+		err = ctrl.NewControllerManagedBy(mgr).
+			Named("nodeqosconfig").
+			Watches(&source.Kind{Type: &qosv1alpha1.NodeQoSConfig{}}, toNode, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+			Watches(&source.Kind{Type: &corev1.Node{}}, toNode, builder.WithPredicates(predicate.LabelChangedPredicate{})).
+			Complete(&reconcileNodeQoSConfig{
+				client:   mgr.GetClient(),
+				reader:   mgr.GetAPIReader(),
+				nodeName: nodeName,
+				syncer:   global,
+			})
+		if err != nil {
+			return err
+		}
+	}
 	return mgr.Start(ctx)
 }
 
@@ -85,12 +138,23 @@ type reconcilePod struct {
 	client client.Client
 
 	syncer types.SyncPod
+
+	// classNames map the qos class annotation to the priority
+	classNames map[string]uint32
 }
 
 // Implement reconcile.Reconciler so the controller can reconcile objects
 var _ reconcile.Reconciler = &reconcilePod{}
 
 func (r *reconcilePod) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	result, err := r.reconcile(ctx, request)
+	if err != nil {
+		metrics.ReconcileErrorsTotal.Inc()
+	}
+	return result, err
+}
+
+func (r *reconcilePod) reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
 	pod := corev1.Pod{}
 	err := r.client.Get(ctx, client.ObjectKey{
 		Namespace: request.Namespace,
@@ -124,8 +188,8 @@ func (r *reconcilePod) Reconcile(ctx context.Context, request reconcile.Request)
 		}
 	}
 
-	v4, v6 := getIPs(&pod)
-	if !v4.IsValid() && !v6.IsValid() {
+	ips := getIPs(&pod)
+	if len(ips) == 0 {
 		return reconcile.Result{}, fmt.Errorf("pod %s/%s has no ip", pod.Namespace, pod.Name)
 	}
 
@@ -134,52 +198,41 @@ func (r *reconcilePod) Reconcile(ctx context.Context, request reconcile.Request)
 		return reconcile.Result{}, fmt.Errorf("error extract bandwidth resources, %w", err)
 	}
 
-	update := &types.PodConfig{
-		PodID:       fmt.Sprintf("%s/%s", pod.Namespace, pod.Name),
-		PodUID:      string(pod.UID),
-		IPv4:        v4,
-		IPv6:        v6,
-		HostNetwork: pod.Spec.HostNetwork,
-	}
-
-	if ingress != nil {
-		v := uint64(ingress.Value())
-		update.RxBps = &(v)
-	}
-	if egress != nil {
-		v := uint64(egress.Value())
-		update.TxBps = &(v)
-	}
-	switch pod.Annotations["k8s.aliyun.com/qos-class"] {
-	case "best-effort":
-		update.Prio = func(a uint32) *uint32 {
-			return &a
-		}(2)
-	case "burstable":
-		update.Prio = func(a uint32) *uint32 {
-			return &a
-		}(1)
-	case "guaranteed":
-		update.Prio = func(a uint32) *uint32 {
-			return &a
-		}(0)
+	ingressBurst, egressBurst, err := bandwidth.ExtractPodBurst(pod.Annotations)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("error extract burst, %w", err)
 	}
 
-	return reconcile.Result{}, r.syncer.UpdatePod(update)
-}
+	networkRates, err := getNetworkRates(&pod)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("error extract network bandwidth, %w", err)
+	}
 
-func getIPs(pod *corev1.Pod) (v4 netip.Addr, v6 netip.Addr) {
-	for _, ip := range pod.Status.PodIPs {
-		addr, err := netip.ParseAddr(ip.IP)
-		if err != nil {
-			continue
-		}
-		if addr.Is4() {
-			v4 = addr
-		} else {
-			v6 = addr
-		}
+	cidrRates, err := getCIDRRates(&pod)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("error extract cidr bandwidth, %w", err)
 	}
 
-	return
+	portClasses, err := getPortClasses(&pod, r.classNames)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("error extract port class, %w", err)
+	}
+
+	update := &types.PodConfig{
+		PodID:        fmt.Sprintf("%s/%s", pod.Namespace, pod.Name),
+		PodUID:       string(pod.UID),
+		IPs:          ips,
+		HostNetwork:  pod.Spec.HostNetwork,
+		RxBps:        ingress,
+		TxBps:        egress,
+		RxBurst:      ingressBurst,
+		TxBurst:      egressBurst,
+		NetworkRates: networkRates,
+		CIDRRates:    cidrRates,
+		PortClasses:  portClasses,
+	}
+
+	update.Prio = getPrio(&pod, r.classNames)
+
+	return reconcile.Result{}, r.syncer.UpdatePod(update)
 }
@@ -31,8 +31,7 @@ func (p *predicateForPod) Create(e event.CreateEvent) bool {
 		return false
 	}
 
-	v4, v6 := getIPs(pod)
-	if !v4.IsValid() && !v6.IsValid() {
+	if len(getIPs(pod)) == 0 {
 		return false
 	}
 
@@ -45,8 +44,7 @@ func (p *predicateForPod) Update(e event.UpdateEvent) bool {
 		return false
 	}
 
-	v4, v6 := getIPs(pod)
-	if !v4.IsValid() && !v6.IsValid() {
+	if len(getIPs(pod)) == 0 {
 		return false
 	}
 
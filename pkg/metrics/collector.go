@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/bpf"
+	"github.com/AliyunContainerService/terway-qos/pkg/types"
+)
+
+// PodLister list pods known by the daemon
+type PodLister interface {
+	ListPods() []types.PodConfig
+}
+
+var (
+	globalConfigDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "global_config_bps"),
+		"Configured global bandwidth of each class, in bytes/s.",
+		[]string{"interface", "direction", "class", "bound"}, nil)
+	hwGuaranteedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "hw_guaranteed_bps"),
+		"Configured host bandwidth, in bytes/s.",
+		[]string{"interface", "direction"}, nil)
+	hwBurstableDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "hw_burstable_bps"),
+		"Configured host bandwidth while there is burst credit, in bytes/s.",
+		[]string{"interface", "direction"}, nil)
+	burstCreditDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "burst_credit_bytes"),
+		"Burst credit left over the guaranteed host bandwidth, in bytes.",
+		[]string{"interface", "direction"}, nil)
+	classLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "class_limit_bps"),
+		"Current bandwidth limit of each class adjusted by the datapath, in bytes/s.",
+		[]string{"interface", "direction", "class"}, nil)
+	throughputDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "throughput_bps"),
+		"Host throughput sampled by the datapath in the last second, in bytes/s.",
+		[]string{"interface", "direction"}, nil)
+	podLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "pod_limit_bps"),
+		"Configured pod bandwidth limit, in bytes/s.",
+		[]string{"namespace", "pod", "direction"}, nil)
+	podBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "pod_bytes_total"),
+		"Bytes seen by the pod limiter, by verdict.",
+		[]string{"namespace", "pod", "direction", "verdict"}, nil)
+	podPacketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "pod_packets_total"),
+		"Packets seen by the pod limiter, by verdict.",
+		[]string{"namespace", "pod", "direction", "verdict"}, nil)
+	classBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "class_bytes_total"),
+		"Bytes seen by the global limiter, by verdict.",
+		[]string{"direction", "class", "verdict"}, nil)
+	classPacketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "class_packets_total"),
+		"Packets seen by the global limiter, by verdict.",
+		[]string{"direction", "class", "verdict"}, nil)
+)
+
+var _ prometheus.Collector = &Collector{}
+
+// Collector read bpf maps on every scrape
+type Collector struct {
+	bpf  bpf.Interface
+	pods PodLister
+}
+
+func NewCollector(bpfWriter bpf.Interface, pods PodLister) *Collector {
+	return &Collector{
+		bpf:  bpfWriter,
+		pods: pods,
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- globalConfigDesc
+	ch <- hwGuaranteedDesc
+	ch <- hwBurstableDesc
+	ch <- burstCreditDesc
+	ch <- classLimitDesc
+	ch <- throughputDesc
+	ch <- podLimitDesc
+	ch <- podBytesDesc
+	ch <- podPacketsDesc
+	ch <- classBytesDesc
+	ch <- classPacketsDesc
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.collectGlobal(ch)
+	c.collectPods(ch)
+}
+
+// collectGlobal export the config, limit and throughput of each interface with its own config. Interfaces without
+// their own config share the global one, and are exported as the default interface.
+func (c *Collector) collectGlobal(ch chan<- prometheus.Metric) {
+	configs, err := c.bpf.ListGlobalConfig()
+	if err != nil {
+		log.Error(err, "error list global config")
+	}
+	ifindexes := sets.New[uint32]()
+	for ifindex, cfg := range configs {
+		ifindexes.Insert(ifindex)
+		name := interfaceName(ifindex)
+		ingressRate, egressRate := c.bpf.GetInterfaceRateLimit(ifindex)
+		collectDirection(ch, name, "ingress", cfg.Ingress, ingressRate.Credit, func(i int) uint64 { return ingressRate.Classes[i].Bps })
+		collectDirection(ch, name, "egress", cfg.Egress, egressRate.Credit, func(i int) uint64 { return egressRate.Classes[i].Bps })
+	}
+
+	for key := range c.bpf.GetNetStat() {
+		ifindexes.Insert(key.Ifindex)
+	}
+	for ifindex := range ifindexes {
+		name := interfaceName(ifindex)
+		ingress, egress := c.bpf.GetInterfaceThroughput(ifindex)
+		ch <- prometheus.MustNewConstMetric(throughputDesc, prometheus.GaugeValue, float64(ingress), name, "ingress")
+		ch <- prometheus.MustNewConstMetric(throughputDesc, prometheus.GaugeValue, float64(egress), name, "egress")
+	}
+
+	for id, stat := range c.bpf.ListClassStat() {
+		class := className(int(id.ClassID))
+		direction := bpf.DirectionName(id.Direction)
+		for verdict, v := range map[string][2]uint64{
+			"pass":  {stat.PassBytes, stat.PassPackets},
+			"drop":  {stat.DropBytes, stat.DropPackets},
+			"delay": {stat.DelayBytes, stat.DelayPackets},
+			"mark":  {stat.MarkBytes, stat.MarkPackets},
+		} {
+			ch <- prometheus.MustNewConstMetric(classBytesDesc, prometheus.CounterValue, float64(v[0]), direction, class, verdict)
+			ch <- prometheus.MustNewConstMetric(classPacketsDesc, prometheus.CounterValue, float64(v[1]), direction, class, verdict)
+		}
+	}
+}
+
+// collectDirection export the config and current limit of the classes of a direction
+func collectDirection(ch chan<- prometheus.Metric, iface, direction string, cfg *types.GlobalConfig, credit uint64, limit func(i int) uint64) {
+	ch <- prometheus.MustNewConstMetric(hwGuaranteedDesc, prometheus.GaugeValue, float64(cfg.HwGuaranteed), iface, direction)
+	ch <- prometheus.MustNewConstMetric(hwBurstableDesc, prometheus.GaugeValue, float64(cfg.HwBurstableBps), iface, direction)
+	ch <- prometheus.MustNewConstMetric(burstCreditDesc, prometheus.GaugeValue, float64(credit), iface, direction)
+	for i, class := range cfg.Classes {
+		name := className(i)
+		ch <- prometheus.MustNewConstMetric(globalConfigDesc, prometheus.GaugeValue, float64(class.MinBps), iface, direction, name, "min")
+		ch <- prometheus.MustNewConstMetric(globalConfigDesc, prometheus.GaugeValue, float64(class.MaxBps), iface, direction, name, "max")
+		ch <- prometheus.MustNewConstMetric(classLimitDesc, prometheus.GaugeValue, float64(limit(i)), iface, direction, name)
+	}
+}
+
+// interfaceName return the name of the interface as the label, default for the interfaces sharing the global config
+func interfaceName(ifindex uint32) string {
+	if ifindex == 0 {
+		return "default"
+	}
+	link, err := net.InterfaceByIndex(int(ifindex))
+	if err != nil {
+		return strconv.FormatUint(uint64(ifindex), 10)
+	}
+	return link.Name
+}
+
+func (c *Collector) collectPods(ch chan<- prometheus.Metric) {
+	type podName struct {
+		namespace, name string
+	}
+	pods := map[uint64]podName{}
+	for _, pod := range c.pods.ListPods() {
+		if pod.CgroupInfo == nil {
+			continue
+		}
+		ns, name, _ := strings.Cut(pod.PodID, "/")
+		pods[pod.CgroupInfo.Inode] = podName{namespace: ns, name: name}
+	}
+
+	for id, rate := range c.bpf.ListCgroupRate() {
+		// rates of secondary networks are not exported
+		if id.Network != 0 {
+			continue
+		}
+		pod, ok := pods[id.Inode]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(podLimitDesc, prometheus.GaugeValue, float64(rate.LimitBps), pod.namespace, pod.name, bpf.DirectionName(id.Direction))
+	}
+
+	for id, stat := range c.bpf.ListCgroupStat() {
+		pod, ok := pods[id.Inode]
+		if !ok {
+			continue
+		}
+		direction := bpf.DirectionName(id.Direction)
+		for verdict, v := range map[string][2]uint64{
+			"pass":  {stat.PassBytes, stat.PassPackets},
+			"drop":  {stat.DropBytes, stat.DropPackets},
+			"delay": {stat.DelayBytes, stat.DelayPackets},
+			"mark":  {stat.MarkBytes, stat.MarkPackets},
+		} {
+			ch <- prometheus.MustNewConstMetric(podBytesDesc, prometheus.CounterValue, float64(v[0]), pod.namespace, pod.name, direction, verdict)
+			ch <- prometheus.MustNewConstMetric(podPacketsDesc, prometheus.CounterValue, float64(v[1]), pod.namespace, pod.name, direction, verdict)
+		}
+	}
+}
+
+func className(prio int) string {
+	return fmt.Sprintf("L%d", prio)
+}
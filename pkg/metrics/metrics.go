@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const namespace = "terway_qos"
+
+var log = ctrl.Log.WithName("metrics")
+
+var (
+	// Registry is the registry served by the metrics listener
+	Registry = prometheus.NewRegistry()
+
+	// SyncErrorsTotal count errors when syncing config files, by source file
+	SyncErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sync_errors_total",
+		Help:      "Total number of errors when syncing config to bpf maps.",
+	}, []string{"source"})
+
+	// GCRemovedTotal count stale bpf map entries removed, by map
+	GCRemovedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gc_removed_total",
+		Help:      "Total number of stale bpf map entries removed by garbage collection.",
+	}, []string{"map"})
+
+	// ReconcileErrorsTotal count errors when reconciling pods
+	ReconcileErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_errors_total",
+		Help:      "Total number of errors when reconciling pods.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		SyncErrorsTotal,
+		GCRemovedTotal,
+		ReconcileErrorsTotal,
+	)
+}
+
+// Serve start the metrics listener, and stop it when ctx is done
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	go func() {
+		log.Info("serving metrics", "addr", addr)
+		err := server.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error(err, "metrics listener exited")
+		}
+	}()
+
+	return nil
+}
@@ -18,6 +18,14 @@ package types
 import (
 	"fmt"
 	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"github.com/AliyunContainerService/terway-qos/pkg/bandwidth"
 )
 
 type SyncPod interface {
@@ -25,13 +33,31 @@ type SyncPod interface {
 	UpdatePod(config *PodConfig) error
 }
 
+// GarbageCollector delete datapath entries of pods no longer exist
+type GarbageCollector interface {
+	// GC keep entries of pods in alive, and those known by the collector
+	GC(alive []PodConfig) error
+}
+
+// SyncGlobal receive global config from the api server, which takes precedence over the config file
+type SyncGlobal interface {
+	// UpdateGlobalConfig set nil to fall back to the config file
+	UpdateGlobalConfig(ingress, egress *GlobalConfig) error
+}
+
+// InterfaceConfig is the global config of an interface, which has its own budget instead of sharing the default
+type InterfaceConfig struct {
+	Ingress *GlobalConfig
+	Egress  *GlobalConfig
+}
+
 // PodConfig contain pod related resource
 type PodConfig struct {
 	PodID  string
 	PodUID string
 
-	IPv4 netip.Addr
-	IPv6 netip.Addr
+	// IPs of the pod on all networks
+	IPs []PodIP
 
 	HostNetwork bool
 	Prio        *uint32
@@ -40,65 +66,362 @@ type PodConfig struct {
 
 	RxBps *uint64
 	TxBps *uint64
+	// RxBurst and TxBurst are the bucket size in bytes, 0 for one second of traffic
+	RxBurst uint64
+	TxBurst uint64
+
+	// NetworkRates limit secondary networks separately, others are limited by RxBps and TxBps
+	NetworkRates []NetworkRate
+	// CIDRRates limit traffic to or from the peers in a cidr, which takes precedence over other rates
+	CIDRRates []CIDRRate
+	// PortClasses classify traffic of the pod by protocol and port, the first match wins, others take the pod class
+	PortClasses []PortClass
+}
+
+// PodIP is an address of the pod
+type PodIP struct {
+	Addr netip.Addr
+	// Network the address belongs to, 0 for the default network
+	Network uint32
+}
+
+// NetworkRate is the rate limit of a secondary network
+type NetworkRate struct {
+	Network uint32
+
+	RxBps uint64
+	TxBps uint64
+}
+
+// CIDRRate is the rate limit of the pod to or from the peers in a cidr, the longest prefix wins
+type CIDRRate struct {
+	CIDR netip.Prefix
+
+	// RxBps and TxBps are nil to fall back to the pod rate, 0 for unlimited
+	RxBps *uint64
+	TxBps *uint64
+}
+
+// CIDRBandwidth is the bandwidth to or from the peers in a cidr, 0 for unlimited
+type CIDRBandwidth struct {
+	Ingress *bandwidth.Bps `json:"ingress,omitempty"`
+	Egress  *bandwidth.Bps `json:"egress,omitempty"`
+}
+
+// ParseCIDRRates convert bandwidth keyed by cidr to rates, sorted by cidr
+func ParseCIDRRates(limits map[string]CIDRBandwidth) ([]CIDRRate, error) {
+	var result []CIDRRate
+	for k, v := range limits {
+		prefix, err := netip.ParsePrefix(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q, %w", k, err)
+		}
+		if v.Ingress == nil && v.Egress == nil {
+			continue
+		}
+		rate := CIDRRate{CIDR: prefix.Masked()}
+		if v.Ingress != nil {
+			rx := uint64(*v.Ingress)
+			rate.RxBps = &rx
+		}
+		if v.Egress != nil {
+			tx := uint64(*v.Egress)
+			rate.TxBps = &tx
+		}
+		result = append(result, rate)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CIDR.String() < result[j].CIDR.String()
+	})
+	return result, nil
+}
+
+// MaxPortClasses is the number of port rules of a pod supported by the datapath
+const MaxPortClasses = 16
+
+// PortClass put tcp or udp traffic of the pod within the port range into a priority class
+type PortClass struct {
+	// Protocol is unix.IPPROTO_TCP or unix.IPPROTO_UDP, 0 for both
+	Protocol uint8
+	// Peer match the port of the peer instead of the pod
+	Peer    bool
+	PortMin uint16
+	PortMax uint16
+	Class   uint32
 }
 
 type CgroupInfo struct {
 	Path    string
 	ClassID uint32
 	Inode   uint64
+
+	// V2 is set when Inode is the cgroup v2 id of the unified hierarchy
+	V2 bool
 }
 
 type CgroupRate struct {
 	Inode uint64
+	// Network is 0 for the rate of the whole pod
+	Network uint32
 
 	RxBps uint64
 	TxBps uint64
+	// RxBurst and TxBurst are the bucket size in bytes, 0 for one second of traffic
+	RxBurst uint64
+	TxBurst uint64
+}
+
+// DefaultAdjustInterval is the interval the datapath adjust rate of each class
+const DefaultAdjustInterval = time.Second
+
+// MinAdjustInterval the datapath estimate rate every 100ms by default, a shorter interval make no sense
+const MinAdjustInterval = 100 * time.Millisecond
+
+const (
+	// EstimatorWindow average the throughput over a sliding window of slots
+	EstimatorWindow = "window"
+	// EstimatorEWMA decay the throughput of each slot by a half-life
+	EstimatorEWMA = "ewma"
+)
+
+const (
+	DefaultSlotWidth = 100 * time.Millisecond
+	DefaultSlotNum   = 10
+	DefaultHalfLife  = 500 * time.Millisecond
+
+	MinSlotWidth = 10 * time.Millisecond
+	MaxSlotWidth = time.Second
+	// MaxSlotNum is the number of slots supported by the datapath
+	MaxSlotNum  = 16
+	MinHalfLife = 10 * time.Millisecond
+)
+
+// RateEstimator estimate the throughput of the host, which the rate of classes is adjusted by
+type RateEstimator struct {
+	// Type is EstimatorWindow or EstimatorEWMA
+	Type string
+	// SlotWidth is the interval the throughput is estimated
+	SlotWidth time.Duration
+	// SlotNum is the slots of the window
+	SlotNum uint32
+	// HalfLife of the ewma
+	HalfLife time.Duration
+}
+
+func (e *RateEstimator) Default() {
+	if e.Type == "" {
+		e.Type = EstimatorWindow
+	}
+	if e.SlotWidth == 0 {
+		e.SlotWidth = DefaultSlotWidth
+	}
+	if e.SlotNum == 0 {
+		e.SlotNum = DefaultSlotNum
+	}
+	if e.HalfLife == 0 {
+		e.HalfLife = DefaultHalfLife
+	}
+}
+
+// Validate check the estimator, zero values are left to Default
+func (e *RateEstimator) Validate(fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if e.Type != "" && e.Type != EstimatorWindow && e.Type != EstimatorEWMA {
+		errs = append(errs, field.NotSupported(fldPath.Child("type"), e.Type, []string{EstimatorWindow, EstimatorEWMA}))
+	}
+	if e.SlotWidth != 0 && (e.SlotWidth < MinSlotWidth || e.SlotWidth > MaxSlotWidth) {
+		errs = append(errs, field.Invalid(fldPath.Child("slotWidth"), e.SlotWidth, fmt.Sprintf("must be between %s and %s", MinSlotWidth, MaxSlotWidth)))
+	}
+	if e.SlotNum > MaxSlotNum {
+		errs = append(errs, field.Invalid(fldPath.Child("slotNum"), e.SlotNum, fmt.Sprintf("must not exceed %d", MaxSlotNum)))
+	}
+	if e.HalfLife != 0 && e.HalfLife < MinHalfLife {
+		errs = append(errs, field.Invalid(fldPath.Child("halfLife"), e.HalfLife, fmt.Sprintf("must be at least %s", MinHalfLife)))
+	}
+	return errs
+}
+
+func (e *RateEstimator) String() string {
+	if e.Type == EstimatorEWMA {
+		return fmt.Sprintf("ewma slot %s half-life %s", e.SlotWidth, e.HalfLife)
+	}
+	return fmt.Sprintf("%s %dx%s", e.Type, e.SlotNum, e.SlotWidth)
+}
+
+// MaxClasses is the number of priority classes supported by the datapath
+const MaxClasses = 8
+
+// DefaultClasses are L0 online, L1 and L2 offline
+const DefaultClasses = 3
+
+// ClassConfig is the bandwidth of a priority class
+type ClassConfig struct {
+	MinBps uint64
+	MaxBps uint64
 }
 
 type GlobalConfig struct {
-	HwGuaranteed   uint64
-	HwBurstableBps uint64
+	// Interval to adjust rate of each class
+	Interval time.Duration
+	// Estimator of the throughput the rate is adjusted by
+	Estimator RateEstimator
 
-	L0MaxBps uint64
-	L0MinBps uint64
+	HwGuaranteed uint64
+	// HwBurstableBps is the host bandwidth while there is BurstCredit, HwGuaranteed if not set
+	HwBurstableBps uint64
+	// BurstCredit is the max bytes earned under HwGuaranteed, and spent over it. 0 to disable bursting
+	BurstCredit uint64
 
-	L1MaxBps uint64
-	L1MinBps uint64
+	// Classes index by priority, class 0 is the online class and has the highest priority
+	Classes []ClassConfig
+}
 
-	L2MaxBps uint64
-	L2MinBps uint64
+// Class return config of the class, Classes is extended if needed
+func (c *GlobalConfig) Class(prio int) *ClassConfig {
+	for len(c.Classes) <= prio {
+		c.Classes = append(c.Classes, ClassConfig{})
+	}
+	return &c.Classes[prio]
 }
 
 func (c *GlobalConfig) Default() {
+	if c.Interval == 0 {
+		c.Interval = DefaultAdjustInterval
+	}
+	c.Estimator.Default()
 	if c.HwGuaranteed != 0 && c.HwBurstableBps == 0 {
 		c.HwBurstableBps = c.HwGuaranteed
 	}
-	if c.L0MaxBps == 0 {
-		c.L0MaxBps = c.HwGuaranteed
+	// at least the default classes
+	c.Class(DefaultClasses - 1)
+	l0 := &c.Classes[0]
+	if l0.MaxBps == 0 {
+		l0.MaxBps = c.HwBurstableBps
+	}
+	// the remain of the offline min, up to the max.
+	// leave it to Validate if the offline min exceed the host bandwidth
+	if l0.MinBps == 0 {
+		remain := c.HwGuaranteed
+		for _, class := range c.Classes[1:] {
+			if class.MinBps > remain {
+				return
+			}
+			remain -= class.MinBps
+		}
+		l0.MinBps = min(remain, l0.MaxBps)
+	}
+}
+
+// Validate check the config, fldPath is used as prefix of the field errors
+func (c *GlobalConfig) Validate(fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	if c.Interval != 0 && c.Interval < MinAdjustInterval {
+		errs = append(errs, field.Invalid(fldPath.Child("interval"), c.Interval, fmt.Sprintf("must be at least %s", MinAdjustInterval)))
+	}
+	errs = append(errs, c.Estimator.Validate(fldPath.Child("estimator"))...)
+	if len(c.Classes) > MaxClasses {
+		errs = append(errs, field.TooMany(fldPath.Child("classes"), len(c.Classes), MaxClasses))
+		return errs
+	}
+
+	disabled := c.HwBurstableBps == 0
+	for _, class := range c.Classes {
+		disabled = disabled && class.MinBps == 0 && class.MaxBps == 0
+	}
+	if disabled {
+		return errs
+	}
+
+	if c.HwGuaranteed > c.HwBurstableBps {
+		errs = append(errs, field.Invalid(fldPath.Child("hwBurstableBps"), bandwidth.Bps(c.HwBurstableBps), "must not be less than hwGuaranteed"))
+	}
+	if c.BurstCredit != 0 && c.HwBurstableBps <= c.HwGuaranteed {
+		errs = append(errs, field.Invalid(fldPath.Child("burstCredit"), bandwidth.Bps(c.BurstCredit), "requires hwBurstableBps greater than hwGuaranteed"))
+	}
+	// a class can burst up to the burstable host bandwidth
+	hwMax := max(c.HwGuaranteed, c.HwBurstableBps)
+	for i, class := range c.Classes {
+		if class.MaxBps > hwMax {
+			errs = append(errs, field.Invalid(fldPath.Child(classField(i, "MaxBps")), bandwidth.Bps(class.MaxBps), fmt.Sprintf("must not exceed hwBurstableBps %d", hwMax)))
+		}
+	}
+	for i, class := range c.Classes {
+		if class.MinBps > class.MaxBps {
+			errs = append(errs, field.Invalid(fldPath.Child(classField(i, "MinBps")), bandwidth.Bps(class.MinBps), fmt.Sprintf("must not exceed %s %d", classField(i, "MaxBps"), class.MaxBps)))
+		}
 	}
-	if c.L0MinBps == 0 {
-		c.L0MinBps = c.HwGuaranteed - c.L1MinBps - c.L2MinBps
+
+	// the offline classes together can not take all the host bandwidth
+	remain := c.HwGuaranteed
+	for i := 1; i < len(c.Classes); i++ {
+		if c.Classes[i].MaxBps > hwMax {
+			break
+		}
+		if c.Classes[i].MaxBps > remain {
+			errs = append(errs, field.Invalid(fldPath.Child(classField(i, "MaxBps")), bandwidth.Bps(c.Classes[i].MaxBps), fmt.Sprintf("sum of max of l1 to %s must not exceed hwGuaranteed %d", classField(i, ""), c.HwGuaranteed)))
+			break
+		}
+		remain -= c.Classes[i].MaxBps
+	}
+
+	// the sum of min bandwidth of all classes can not exceed the host bandwidth, the online class is the last
+	remain = c.HwGuaranteed
+	for n := 1; n <= len(c.Classes); n++ {
+		i := n % len(c.Classes)
+		if c.Classes[i].MinBps > remain {
+			errs = append(errs, field.Invalid(fldPath.Child(classField(i, "MinBps")), bandwidth.Bps(c.Classes[i].MinBps), fmt.Sprintf("sum of min of all classes must not exceed hwGuaranteed %d", c.HwGuaranteed)))
+			break
+		}
+		remain -= c.Classes[i].MinBps
 	}
+
+	return errs
 }
 
-func (c *GlobalConfig) Validate() bool {
-	if c.HwBurstableBps == 0 && c.L0MaxBps == 0 && c.L0MinBps == 0 && c.L1MaxBps == 0 && c.L1MinBps == 0 && c.L2MaxBps == 0 && c.L2MinBps == 0 {
-		return true
+// ParseClass parse a priority class like L2 or 2
+func ParseClass(s string) (uint32, error) {
+	prio, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "L"), 10, 32)
+	if err != nil || prio >= MaxClasses {
+		return 0, fmt.Errorf("invalid class %q, expect L0 to L%d", s, MaxClasses-1)
 	}
+	return uint32(prio), nil
+}
 
-	if c.HwGuaranteed > c.HwBurstableBps ||
-		c.HwGuaranteed < c.L1MaxBps ||
-		c.HwGuaranteed < c.L2MaxBps ||
-		c.L1MinBps > c.L1MaxBps ||
-		c.L2MinBps > c.L2MaxBps ||
-		c.HwGuaranteed < c.L2MaxBps+c.L1MaxBps {
-		return false
+// ParseClassRate parse the min and max of a class like L3=10M,100M, in the format accepted by bandwidth.ParseBps
+func ParseClassRate(s string) (uint32, ClassConfig, error) {
+	name, rates, ok := strings.Cut(s, "=")
+	minBps, maxBps, ok2 := strings.Cut(rates, ",")
+	if !ok || !ok2 {
+		return 0, ClassConfig{}, fmt.Errorf("invalid class rate %q, expect <class>=<min>,<max> like L3=10M,100M", s)
+	}
+	prio, err := ParseClass(name)
+	if err != nil {
+		return 0, ClassConfig{}, err
 	}
+	var class ClassConfig
+	if class.MinBps, err = bandwidth.ParseBps(minBps); err != nil {
+		return 0, ClassConfig{}, err
+	}
+	if class.MaxBps, err = bandwidth.ParseBps(maxBps); err != nil {
+		return 0, ClassConfig{}, err
+	}
+	return prio, class, nil
+}
 
-	return true
+// classField return field name of the class, e.g. l1MaxBps
+func classField(prio int, name string) string {
+	return fmt.Sprintf("l%d%s", prio, name)
 }
 
 func (c *GlobalConfig) String() string {
-	return fmt.Sprintf("hw %d online-min %d online-max %d offline-l1-min %d offline-l1-max %d offline-l2-min %d offline-l2-max %d",
-		c.HwGuaranteed, c.L0MinBps, c.L0MaxBps, c.L1MinBps, c.L1MaxBps, c.L2MinBps, c.L2MaxBps)
+	var b strings.Builder
+	fmt.Fprintf(&b, "interval %s estimator %s hw %d", c.Interval, &c.Estimator, c.HwGuaranteed)
+	if c.BurstCredit != 0 {
+		fmt.Fprintf(&b, " hw-burstable %d burst-credit %d", c.HwBurstableBps, c.BurstCredit)
+	}
+	for i, class := range c.Classes {
+		fmt.Fprintf(&b, " l%d-min %d l%d-max %d", i, class.MinBps, i, class.MaxBps)
+	}
+	return b.String()
 }
@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2023, Alibaba Group;
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package types
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestGlobalConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    GlobalConfig
+		fields []string
+	}{
+		{
+			name: "disabled",
+			cfg:  GlobalConfig{},
+		},
+		{
+			name: "valid",
+			cfg:  GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{}, {MinBps: 100, MaxBps: 200}, {MinBps: 100, MaxBps: 300}}},
+		},
+		{
+			name:   "interval too short",
+			cfg:    GlobalConfig{Interval: 10 * time.Millisecond},
+			fields: []string{"egress.interval"},
+		},
+		{
+			name:   "min greater than max",
+			cfg:    GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{}, {MinBps: 300, MaxBps: 200}}},
+			fields: []string{"egress.l1MinBps"},
+		},
+		{
+			name:   "max exceed hw",
+			cfg:    GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{}, {MaxBps: 600}, {MaxBps: 600}}},
+			fields: []string{"egress.l2MaxBps"},
+		},
+		{
+			name:   "sum of min exceed hw",
+			cfg:    GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{MinBps: 500}, {MinBps: 300, MaxBps: 400}, {MinBps: 300, MaxBps: 500}}},
+			fields: []string{"egress.l0MinBps"},
+		},
+		{
+			name: "explicit l0",
+			cfg:  GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{MinBps: 400, MaxBps: 700}, {MinBps: 100, MaxBps: 200}, {MinBps: 100, MaxBps: 300}}},
+		},
+		{
+			name:   "l0 max exceed hw",
+			cfg:    GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{MaxBps: 1200}, {MinBps: 100, MaxBps: 200}}},
+			fields: []string{"egress.l0MaxBps"},
+		},
+		{
+			name:   "l0 min greater than max",
+			cfg:    GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{MinBps: 600, MaxBps: 500}, {MinBps: 100, MaxBps: 200}}},
+			fields: []string{"egress.l0MinBps"},
+		},
+		{
+			name: "burstable",
+			cfg:  GlobalConfig{HwGuaranteed: 1000, HwBurstableBps: 1500, BurstCredit: 1 << 30, Classes: []ClassConfig{{}, {MinBps: 100, MaxBps: 200}}},
+		},
+		{
+			name:   "burst credit without burstable",
+			cfg:    GlobalConfig{HwGuaranteed: 1000, BurstCredit: 1 << 30, Classes: []ClassConfig{{MaxBps: 1200}}},
+			fields: []string{"egress.burstCredit", "egress.l0MaxBps"},
+		},
+		{
+			name: "five classes",
+			cfg:  GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{}, {MinBps: 100, MaxBps: 200}, {MinBps: 100, MaxBps: 200}, {MinBps: 100, MaxBps: 200}, {MinBps: 100, MaxBps: 200}}},
+		},
+		{
+			name: "ewma",
+			cfg:  GlobalConfig{Estimator: RateEstimator{Type: EstimatorEWMA, SlotWidth: 20 * time.Millisecond, HalfLife: 200 * time.Millisecond}},
+		},
+		{
+			name:   "invalid estimator",
+			cfg:    GlobalConfig{Estimator: RateEstimator{Type: "avg", SlotWidth: time.Millisecond, SlotNum: MaxSlotNum + 1, HalfLife: time.Millisecond}},
+			fields: []string{"egress.estimator.type", "egress.estimator.slotWidth", "egress.estimator.slotNum", "egress.estimator.halfLife"},
+		},
+		{
+			name:   "too many classes",
+			cfg:    GlobalConfig{HwGuaranteed: 1000, Classes: make([]ClassConfig, MaxClasses+1)},
+			fields: []string{"egress.classes"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Default()
+			errs := tt.cfg.Validate(field.NewPath("egress"))
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.Field)
+			}
+			if len(got) != len(tt.fields) {
+				t.Fatalf("Validate() = %v, want fields %v", errs, tt.fields)
+			}
+			for i := range got {
+				if got[i] != tt.fields[i] {
+					t.Errorf("Validate() = %v, want fields %v", errs, tt.fields)
+				}
+			}
+		})
+	}
+}
+
+func TestGlobalConfigDefaultUnderflow(t *testing.T) {
+	cfg := GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{}, {MinBps: 600}, {MinBps: 500}}}
+	cfg.Default()
+	if cfg.Classes[0].MinBps != 0 {
+		t.Errorf("L0 MinBps = %d, want 0", cfg.Classes[0].MinBps)
+	}
+}
+
+func TestGlobalConfigDefaultL0(t *testing.T) {
+	cfg := GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{MaxBps: 700}, {MinBps: 100}, {MinBps: 200}}}
+	cfg.Default()
+	if cfg.Classes[0].MinBps != 700 || cfg.Classes[0].MaxBps != 700 {
+		t.Errorf("L0 = %+v, want explicit max kept and min of the remain", cfg.Classes[0])
+	}
+
+	cfg = GlobalConfig{HwGuaranteed: 1000, Classes: []ClassConfig{{MaxBps: 500}, {MinBps: 100, MaxBps: 200}, {MinBps: 200, MaxBps: 300}}}
+	cfg.Default()
+	if cfg.Classes[0].MinBps != 500 || len(cfg.Validate(nil)) != 0 {
+		t.Errorf("L0 = %+v, want min capped by the explicit max", cfg.Classes[0])
+	}
+}
+
+func TestParseClassRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		prio    uint32
+		class   ClassConfig
+		wantErr bool
+	}{
+		{in: "L3=10M,100M", prio: 3, class: ClassConfig{MinBps: 10000000, MaxBps: 100000000}},
+		{in: "7=0,1Gbit", prio: 7, class: ClassConfig{MaxBps: 125000000}},
+		{in: "L8=0,100M", wantErr: true},
+		{in: "L3=100M", wantErr: true},
+		{in: "L3", wantErr: true},
+		{in: "L3=1x,100M", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			prio, class, err := ParseClassRate(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseClassRate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if prio != tt.prio || class != tt.class {
+				t.Errorf("ParseClassRate() = %d %+v, want %d %+v", prio, class, tt.prio, tt.class)
+			}
+		})
+	}
+}